@@ -0,0 +1,177 @@
+/* authd/authd/admin.go */
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+/* Role - what an admin credential may do */
+type Role string
+
+const (
+	RoleAdmin = Role("admin") /* everything */
+	RoleOperator = Role("operator") /* put and delete records in existing buckets */
+	RoleAuditor = Role("auditor") /* read only */
+)
+
+/* Permission - what an admin call needs */
+type Permission int
+
+const (
+	PermRead Permission = iota
+	PermRecords
+	PermBuckets
+	PermApiKeys
+)
+
+var (
+	RoleInvalid = errors.New("Invalid Role")
+	AdminInvalid = errors.New("Invalid Admin Credential")
+	AdminSecretReused = errors.New("Admin Secret Already In Use")
+)
+
+func (r Role) IsValid() bool {
+
+	switch r {
+	case RoleAdmin,RoleOperator,RoleAuditor:
+		return true
+	}
+	return false
+}
+
+/* Can - does the role grant the permission */
+func (r Role) Can(p Permission) bool {
+
+	switch r {
+	case RoleAdmin:
+		return true
+	case RoleOperator:
+		return p == PermRead || p == PermRecords
+	case RoleAuditor:
+		return p == PermRead
+	}
+	return false
+}
+
+/* AdminCredential - a named X-AdminKey secret and its role */
+type AdminCredential struct {
+
+	Name string
+	Role Role
+	secret []byte
+}
+
+/* AdminSet - every admin credential accepted by the service */
+type AdminSet struct {
+
+	mu sync.RWMutex
+	creds []AdminCredential
+}
+
+func (s *AdminSet) Add(name string,role Role,secret string) error {
+
+	if !role.IsValid() {
+		return RoleInvalid
+	}
+	if name == "" || secret == "" {
+		return AdminInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _,c := range s.creds {
+		if c.Name == name {
+			return AlreadyPresent
+		}
+		/* a shared secret would authenticate as whichever credential came last */
+		if subtle.ConstantTimeCompare(c.secret,[]byte(secret)) == 1 {
+			return AdminSecretReused
+		}
+	}
+	s.creds = append(s.creds,AdminCredential{name,role,[]byte(secret)})
+	return nil
+}
+
+/* Authenticate - find the credential for secret, every credential is compared in constant time */
+func (s *AdminSet) Authenticate(secret string) (AdminCredential,bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var match AdminCredential
+	found := false
+	for _,c := range s.creds {
+		if subtle.ConstantTimeCompare(c.secret,[]byte(secret)) == 1 {
+			match = c
+			found = true
+		}
+	}
+	return match,found
+}
+
+func (s *AdminSet) Len() int {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.creds)
+}
+
+/* Load - read credentials from a file, one per line as "name role secret", # for comments */
+func (s *AdminSet) Load(path string) error {
+
+	f,err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line,"#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d expected \"name role secret\"",path,n)
+		}
+		if err := s.Add(fields[0],Role(fields[1]),fields[2]); err != nil {
+			return fmt.Errorf("%s:%d %v",path,n,err)
+		}
+	}
+	return scanner.Err()
+}
+
+func NewAdminSet() *AdminSet {
+
+	s := new(AdminSet)
+	s.creds = make([]AdminCredential,0)
+	return s
+}
+
+type adminKey struct{}
+
+/* AdminOf - the credential an admin call was made with */
+func AdminOf(req *http.Request) (AdminCredential,bool) {
+
+	c,ok := req.Context().Value(adminKey{}).(AdminCredential)
+	return c,ok
+}
+
+func withAdmin(req *http.Request,c AdminCredential) *http.Request {
+
+	return req.WithContext(context.WithValue(req.Context(),adminKey{},c))
+}
@@ -0,0 +1,45 @@
+/* authd/authd/admin_test.go */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_AdminSetLoad(t *testing.T) {
+
+	f,err := ioutil.TempFile("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("# name role secret\n\nalice admin alice-key\nprovisioner operator op-key\n")
+	f.Close()
+
+	s := NewAdminSet()
+	if err := s.Load(f.Name()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 credentials, got %d",s.Len())
+	}
+
+	c,ok := s.Authenticate("op-key")
+	if !ok || c.Name != "provisioner" || c.Role != RoleOperator {
+		t.Fatalf("expected provisioner operator, got %+v",c)
+	}
+	if _,ok := s.Authenticate("op-ke"); ok {
+		t.Fatalf("expected a partial secret to fail")
+	}
+	if err := s.Add("alice",RoleAuditor,"other"); err != AlreadyPresent {
+		t.Fatalf("expected duplicate name to fail, got %v",err)
+	}
+	if err := s.Add("bob",RoleAuditor,"alice-key"); err != AdminSecretReused {
+		t.Fatalf("expected a reused secret to fail, got %v",err)
+	}
+	if err := s.Add("bob","superuser","bob-key"); err != RoleInvalid {
+		t.Fatalf("expected unknown role to fail, got %v",err)
+	}
+}
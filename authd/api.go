@@ -3,12 +3,23 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/url"
 	"fmt"
-	"log"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
 	"github.com/gorilla/mux"
 )
 
+var (
+	ExpiryInvalid = errors.New("Invalid Expiry")
+	UsesInvalid = errors.New("Invalid Uses")
+	BatchInvalid = errors.New("Invalid Batch")
+)
+
 const (
 
 	BucketEmptyResponse = "empty"
@@ -16,16 +27,28 @@ const (
 	KeyFoundResponse = "yes"
 	KeyNotFoundResponse = "no"
 	ActionDoneResponse = "ok"
+	UnauthorizedResponse = "unauthorized"
+	ErrorResponse = "error" /* a batch pair that could not be checked, nothing was consumed */
+
+	MaxBatch = 100 /* pairs in one batch check */
+	maxBatchBody = 1 << 20
 )
 	
 /* GetBucket - ask whether a bucket exists and if so whether it is empty or contains records */
-func ApiV1GetBucketHandler(w http.ResponseWriter,req *http.Request,bucket *Bucket) {
+func ApiV1GetBucketHandler(w http.ResponseWriter,req *http.Request,ctx *Context,bucket *Bucket) {
 
 	/* very terse for added security */
 
 	response := BucketEmptyResponse
 
-	if !bucket.IsEmpty() {
+	empty,err := bucket.IsEmpty()
+	if err != nil {
+
+		RequestLog(req).Error("storage error","bucket",bucket.Name,"error",err)
+		http.Error(w,err.Error(),500)
+		return
+	}
+	if !empty {
 		
 		response = BucketNotEmptyResponse
 	}
@@ -34,35 +57,113 @@ func ApiV1GetBucketHandler(w http.ResponseWriter,req *http.Request,bucket *Bucke
 }
 
 /* GetKey - ask whether a bucket has a certain key (record) */
-func ApiV1GetKeyHandler(w http.ResponseWriter,req *http.Request,bucket *Bucket) {
+func ApiV1GetKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context,bucket *Bucket) {
 
 	vars := mux.Vars(req)
 	key := vars["key"]
 
-	if !bucket.Check(Key(key)) {
+	by := ClientActor(req,ctx.Certs.ApiKey(req))
+	found,limited,err := ctx.UseKey(bucket,Key(key),by)
+	if limited {
+		w.Header().Set("Cache-Control","no-store")
+	}
+	if err != nil {
+
+		RequestLog(req).Error("check failed","bucket",bucket.Name,"key",Redact.Key(Key(key)),"error",err)
 
+		http.Error(w,err.Error(),500)
+		return
+	}
+	if !found {
+
+		ctx.checked(by,bucket.Name,KeyNotFoundResponse)
 		http.Error(w,KeyNotFoundResponse,404)
 		return
 	}
 
+	ctx.checked(by,bucket.Name,KeyFoundResponse)
 	fmt.Fprintf(w,KeyFoundResponse)
 
 }
 
+/* CheckPair - one bucket/key of a batch check, Result is yes, no, unauthorized or error */
+type CheckPair struct {
+
+	Bucket string `json:"bucket"`
+	Key string `json:"key"`
+	Result string `json:"result,omitempty"`
+}
+
+/* Check - ask whether each of a list of buckets has a certain key, every pair is subject to the same
+ * rules as GetKey and answered in order. A pair that fails is answered error and the rest are still
+ * checked, so the client knows exactly which uses were consumed */
+func ApiV1CheckHandler(w http.ResponseWriter,req *http.Request,ctx *Context,api ApiKey) {
+
+	var pairs []CheckPair
+	if err := json.NewDecoder(http.MaxBytesReader(w,req.Body,maxBatchBody)).Decode(&pairs); err != nil {
+
+		http.Error(w,BatchInvalid.Error(),400)
+		return
+	}
+	if len(pairs) == 0 || len(pairs) > MaxBatch {
+
+		http.Error(w,BatchInvalid.Error(),400)
+		return
+	}
+
+	by := ClientActor(req,api)
+	refused := 0
+	for i,p := range pairs {
+
+		pairs[i].Result = UnauthorizedResponse
+
+		b,err := ctx.ClientBucket(api,Key(p.Bucket),ScopeCheck)
+		if err != nil {
+			if err != NotFound {
+				refused++
+			}
+			if err != NotFound && err != BucketNotLive {
+				ctx.Metrics.AuthFailure(AuthApiKey)
+			}
+			ctx.checked(by,Key(p.Bucket),refusedResult(err))
+			continue
+		}
+
+		found,limited,err := ctx.UseKey(b,Key(p.Key),by)
+		if limited {
+			w.Header().Set("Cache-Control","no-store")
+		}
+		if err != nil {
+
+			RequestLog(req).Error("check failed","bucket",b.Name,"key",Redact.Key(Key(p.Key)),"error",err)
+			pairs[i].Result = ErrorResponse
+			ctx.checked(by,b.Name,ErrorResponse)
+			continue
+		}
+		pairs[i].Result = KeyFoundResponse
+		if !found {
+			pairs[i].Result = KeyNotFoundResponse
+		}
+		ctx.checked(by,b.Name,pairs[i].Result)
+	}
+	if refused > 0 {
+		RequestLog(req).Warn("invalid api key","api_key",Redact.ApiKey(api),"remote",req.RemoteAddr,"refused",refused,"buckets",len(pairs))
+	}
+
+	w.Header().Set("Content-Type","application/json")
+	json.NewEncoder(w).Encode(pairs)
+}
+
 /* PutBucket - add a bucket or change it's state */
 func ApiV1PutBucketHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
 
 	vars := mux.Vars(req)
 	bucket := vars["bucket"]
 
-	log.Printf("PUT bucket %s\n",bucket)
+	RequestLog(req).Info("put bucket","bucket",bucket)
 
-	b,err := ctx.SetBucket(Key(bucket))
-	if err != nil {
-		
-		http.Error(w,err.Error(),500)
-		return
-	}
+	mutations := []Mutation{NewMutation(OpSetBucket,Key(bucket))}
+	hashed := false
 
 	/* go through the key=values */
 	for k,vs := range req.Form {
@@ -70,27 +171,62 @@ func ApiV1PutBucketHandler(w http.ResponseWriter,req *http.Request,ctx *Context)
 		switch k {
 		case "enable":
 			if vs[0] == "yes" {
-				b.Enable()
-				log.Printf("enabled bucket %s",bucket)
+				mutations = append(mutations,NewMutation(OpEnableBucket,Key(bucket)))
+				RequestLog(req).Info("enabled bucket","bucket",bucket)
 			}
 			break
 		case "disable":
 			if vs[0] == "yes" {
-				b.Disable()
-				log.Printf("disabled bucket %s",bucket)
+				mutations = append(mutations,NewMutation(OpDisableBucket,Key(bucket)))
+				RequestLog(req).Info("disabled bucket","bucket",bucket)
+			}
+			break
+		case "hash":
+			if vs[0] == "yes" {
+				if !ctx.Hasher.Ready() {
+					http.Error(w,HashSecretMissing.Error(),400)
+					return
+				}
+				mutations = append(mutations,NewMutation(OpHashBucket,Key(bucket)))
+				hashed = true
+				RequestLog(req).Info("hashed bucket","bucket",bucket)
 			}
 			break
 		case "allow":
-			b.AllowApiKey(ApiKey(vs[0]))
-			log.Printf("allowed api key %s @ bucket %s",bucket)
+			m := NewMutation(OpAllowApiKey,Key(bucket))
+			m.ApiKey = ApiKey(vs[0])
+			mutations = append(mutations,m)
+			RequestLog(req).Info("allowed api key","api_key",Redact.ApiKey(m.ApiKey),"bucket",bucket)
 			break
 		case "revoke":
-			b.RevokeApiKey(ApiKey(vs[0]))
-			log.Printf("revoked api key %s @ bucket %s",bucket)
+			m := NewMutation(OpRevokeApiKey,Key(bucket))
+			m.ApiKey = ApiKey(vs[0])
+			mutations = append(mutations,m)
+			RequestLog(req).Info("revoked api key","api_key",Redact.ApiKey(m.ApiKey),"bucket",bucket)
 			break
 		}
 	}
 
+	by := ActorOf(req)
+	for i := range mutations {
+		mutations[i].By = by
+	}
+
+	if err := ctx.Commit(mutations...); err != nil {
+
+		http.Error(w,err.Error(),500)
+		return
+	}
+
+	/* the snapshot and journal still hold the plaintext keys until compacted */
+	if hashed {
+		if err := ctx.Compact(); err != nil {
+
+			http.Error(w,err.Error(),500)
+			return
+		}
+	}
+
 	fmt.Fprintf(w,ActionDoneResponse)
 
 }
@@ -101,9 +237,11 @@ func ApiV1DeleteBucketHandler(w http.ResponseWriter,req *http.Request,ctx *Conte
 	vars := mux.Vars(req)
 	bucket := vars["bucket"]
 
-	log.Printf("Del bucket %s\n",bucket)
+	RequestLog(req).Info("deleted bucket","bucket",bucket)
 
-	err := ctx.DelBucket(Key(bucket))
+	m := NewMutation(OpDelBucket,Key(bucket))
+	m.By = ActorOf(req)
+	err := ctx.Commit(m)
 	if err != nil {
 		
 		http.Error(w,err.Error(),500)
@@ -121,8 +259,6 @@ func ApiV1PutKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
 	key := vars["key"]
 	bucket := vars["bucket"]
 
-	log.Printf("Set %s @ %s\n",key,bucket)
-
 	b := ctx.GetBucket(Key(bucket))
 	if b == nil {
 
@@ -130,11 +266,96 @@ func ApiV1PutKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
 		return
 	}
 
-	b.Set(Key(key))
+	m := NewMutation(OpSetKey,b.Name)
+	m.Record = &Record{Created:m.Time}
+
+	expires,err := parseExpiry(req.Form,m.Time)
+	if err != nil {
+
+		http.Error(w,err.Error(),400)
+		return
+	}
+	m.Record.Expires = expires
+
+	if uses := req.Form.Get("uses"); uses != "" {
+
+		n,err := strconv.Atoi(uses)
+		if err != nil || n < 1 {
+
+			http.Error(w,UsesInvalid.Error(),400)
+			return
+		}
+		m.Record.Uses = n
+	}
+
+	m.By = ActorOf(req)
+	stored,err := ctx.CommitKey(b,Key(key),m)
+	if err != nil {
+
+		http.Error(w,err.Error(),500)
+		return
+	}
+	RequestLog(req).Info("set key","key",Redact.Key(stored),"bucket",bucket)
 
 	fmt.Fprintf(w,ActionDoneResponse)
 }
 
+/* apiKeySpec - label=, ttl= or expires=, bucket= (repeated or comma separated, a trailing '*' matches
+ * a prefix) and action= (status, check) for a key about to be issued */
+func apiKeySpec(form url.Values,now time.Time) (ApiKeyRecord,error) {
+
+	spec := ApiKeyRecord{Label:form.Get("label")}
+
+	expires,err := parseExpiry(form,now)
+	if err != nil {
+		return spec,err
+	}
+	spec.Expires = expires
+
+	for _,v := range form["bucket"] {
+		spec.Buckets = append(spec.Buckets,strings.Split(v,",")...)
+	}
+	for _,v := range form["action"] {
+		spec.Actions = append(spec.Actions,strings.Split(v,",")...)
+	}
+	return spec,spec.Validate()
+}
+
+/* parseExpiry - ttl= as a duration (90s, 5m) or seconds, or expires= as RFC3339 or unix seconds,
+ * zero time when neither is given */
+func parseExpiry(form url.Values,now time.Time) (time.Time,error) {
+
+	ttl,expires := form.Get("ttl"),form.Get("expires")
+
+	switch {
+	case ttl != "" && expires != "":
+		return time.Time{},ExpiryInvalid
+	case ttl != "":
+		d,err := time.ParseDuration(ttl)
+		if err != nil {
+			secs,serr := strconv.ParseInt(ttl,10,64)
+			if serr != nil {
+				return time.Time{},ExpiryInvalid
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		if d <= 0 {
+			return time.Time{},ExpiryInvalid
+		}
+		return now.Add(d),nil
+	case expires != "":
+		if t,err := time.Parse(time.RFC3339,expires); err == nil {
+			return t,nil
+		}
+		secs,err := strconv.ParseInt(expires,10,64)
+		if err != nil {
+			return time.Time{},ExpiryInvalid
+		}
+		return time.Unix(secs,0),nil
+	}
+	return time.Time{},nil
+}
+
 /* DeleteKey - remove a key (record) from containing bucket */
 func ApiV1DeleteKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
 
@@ -142,8 +363,6 @@ func ApiV1DeleteKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context)
 	key := vars["key"]
 	bucket := vars["bucket"]
 
-	log.Printf("Del %s @ %s\n",key,bucket)
-
 	b := ctx.GetBucket(Key(bucket))
 	if b == nil {
 
@@ -151,24 +370,92 @@ func ApiV1DeleteKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context)
 		return
 	}
 
-	b.Del(Key(key))
+	m := NewMutation(OpDelKey,b.Name)
+	m.By = ActorOf(req)
+	stored,err := ctx.CommitKey(b,Key(key),m)
+	if err != nil {
+
+		http.Error(w,err.Error(),500)
+		return
+	}
+	RequestLog(req).Info("deleted key","key",Redact.Key(stored),"bucket",bucket)
 
 	fmt.Fprintf(w,ActionDoneResponse)
 }
 
-/* PutApiKey - create a new Api Key for a client to use */
+/* PutApiKey - create a new Api Key for a client to use, recorded in the registry */
 func ApiV1PutApiKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
 
+	spec,err := apiKeySpec(req.Form,time.Now())
+	if err != nil {
+
+		http.Error(w,err.Error(),400)
+		return
+	}
+
 	/* generate new key */
-	nkey,err := GenerateApiKey(ctx.Namespace)
+	nkey,err := ctx.IssueApiKey(spec,ActorOf(req))
 	if err != nil {
 
 		http.Error(w,err.Error(),500)
 		return
 	}
+
+	RequestLog(req).Info("issued api key","api_key",Redact.ApiKey(nkey))
 	fmt.Fprintf(w,nkey.String())
 }
 
+/* RegisterApiKey - record an Api Key issued before the registry existed so clients can keep using it */
+func ApiV1RegisterApiKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
+
+	vars := mux.Vars(req)
+	key := vars["key"]
+
+	spec,err := apiKeySpec(req.Form,time.Now())
+	if err != nil {
+
+		http.Error(w,err.Error(),400)
+		return
+	}
+
+	if err := ctx.RegisterApiKey(ApiKey(key),spec,ActorOf(req)); err != nil {
+
+		http.Error(w,err.Error(),errorStatus(err))
+		return
+	}
+
+	RequestLog(req).Info("registered api key","api_key",Redact.ApiKey(ApiKey(key)))
+	fmt.Fprintf(w,ActionDoneResponse)
+}
+
+/* RotateApiKey - issue a successor Api Key, the old key stays valid for grace= (or the default) */
+func ApiV1RotateApiKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
+
+	vars := mux.Vars(req)
+	key := vars["key"]
+
+	grace := ctx.RotationGrace
+	if g := req.Form.Get("grace"); g != "" {
+
+		d,err := time.ParseDuration(g)
+		if err != nil || d < 0 {
+			http.Error(w,ExpiryInvalid.Error(),400)
+			return
+		}
+		grace = d
+	}
+
+	nkey,err := ctx.RotateApiKey(ApiKey(key),grace,ActorOf(req))
+	if err != nil {
+
+		http.Error(w,err.Error(),errorStatus(err))
+		return
+	}
+
+	RequestLog(req).Info("rotated api key","api_key",Redact.ApiKey(ApiKey(key)),"rotated_to",Redact.ApiKey(nkey),"grace",grace)
+	fmt.Fprint(w,nkey.String())
+}
+
 /* DeleteApiKey - delete all (revoke globally) an Api Key, preventing its use in future actions */
 func ApiV1DeleteApiKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
 
@@ -176,8 +463,15 @@ func ApiV1DeleteApiKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Conte
 	key := vars["key"]
 
 	/* global : */
-	_,err := ctx.RevokeApiKey(ApiKey(key))
-	if err != nil {
+	if !ApiKey(key).IsValid() {
+		http.Error(w,KeyInvalid.Error(),500)
+		return
+	}
+
+	m := NewMutation(OpRevokeApiKeyGlobal,"")
+	m.ApiKey = ApiKey(key)
+	m.By = ActorOf(req)
+	if err := ctx.Commit(m); err != nil {
 		http.Error(w,err.Error(),500)
 		return
 	}
@@ -185,3 +479,67 @@ func ApiV1DeleteApiKeyHandler(w http.ResponseWriter,req *http.Request,ctx *Conte
 	fmt.Fprintf(w,ActionDoneResponse)
 }
 
+/* errorStatus - the response status for an admin call failing with err, conflicts with what is already
+ * held and missing keys are the caller's, anything else is the service's */
+func errorStatus(err error) int {
+
+	switch err {
+	case AlreadyPresent,ApiKeyAlreadyRotated,ApiKeyRevoked,ApiKeyExpired:
+		return 409
+	case ApiKeyNotIssued,NotFound:
+		return 404
+	}
+	return 500
+}
+
+/* ListBuckets - every bucket with its state, for auditing */
+func ApiV1ListBucketsHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
+
+	type bucketView struct {
+		Name Key `json:"name"`
+		Live bool `json:"live"`
+		Records int `json:"records"`
+		ApiKeys int `json:"api_keys"`
+	}
+
+	list := make([]bucketView,0)
+	for _,b := range ctx.BucketList() {
+
+		live,err := b.IsLive()
+		if err == nil {
+			var n int
+			n,err = b.Len()
+			list = append(list,bucketView{b.Name,live,n,len(b.ApiKeys())})
+		}
+		if err != nil {
+
+			RequestLog(req).Error("storage error","bucket",b.Name,"error",err)
+			http.Error(w,err.Error(),500)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type","application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+/* ListApiKeys - the Api Key registry, keys are obfuscated so the listing cannot be used to impersonate a client */
+func ApiV1ListApiKeysHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
+
+	list,err := ctx.ApiKeyList()
+	if err != nil {
+
+		http.Error(w,err.Error(),500)
+		return
+	}
+
+	for i,rec := range list {
+		list[i].Key = ApiKey(rec.Key.Obf())
+		if rec.RotatedTo != "" {
+			list[i].RotatedTo = ApiKey(rec.RotatedTo.Obf())
+		}
+	}
+
+	w.Header().Set("Content-Type","application/json")
+	json.NewEncoder(w).Encode(list)
+}
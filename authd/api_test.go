@@ -3,10 +3,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"fmt"
+	"os"
 	"testing"
+	"time"
 	"io/ioutil"
+
+	"github.com/gorilla/mux"
 )
 
 var (
@@ -87,6 +95,431 @@ func adminRequest(url string) (int,string,error) {
 
 
 
+/* testServer - the full api over ctx, in process */
+func testServer(ctx *Context) *httptest.Server {
+
+	r := mux.NewRouter()
+	NewApiV1Routes(ctx,r,"127.0.0.1")
+	return httptest.NewServer(r)
+}
+
+/* newTestServer - the full api over a new context holding the default admin key, every bucket
+ * given is created and enabled */
+func newTestServer(t *testing.T,buckets ...string) (*Context,*httptest.Server) {
+
+	ctx := NewContext()
+	ctx.Admins.Add("admin",RoleAdmin,DefaultAdminKey)
+	srv := testServer(ctx)
+	for _,b := range buckets {
+		run(t,srv,asAdmin("PUT","/api/v1/g/" + b + "?enable=yes",200))
+	}
+	return ctx,srv
+}
+
+/* apiCall - a request made by a table driven test and the status it should get */
+type apiCall struct {
+
+	method,url,header,value string
+	expect int
+}
+
+/* asAdmin - a call made with the default admin key */
+func asAdmin(method,url string,expect int) apiCall {
+
+	return apiCall{method,url,"X-AdminKey",DefaultAdminKey,expect}
+}
+
+/* asClient - a call made with an Api Key */
+func asClient(key ApiKey,method,url string,expect int) apiCall {
+
+	return apiCall{method,url,"X-ApiKey",key.String(),expect}
+}
+
+/* run - make each call in turn, failing on the first to get an unexpected status */
+func run(t *testing.T,srv *httptest.Server,calls ...apiCall) {
+
+	for _,c := range calls {
+		fetch(t,srv,c)
+	}
+}
+
+/* fetch - make a call that must get the expected status, returning the body */
+func fetch(t *testing.T,srv *httptest.Server,c apiCall) string {
+
+	req,err := http.NewRequest(c.method,srv.URL + c.url,nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if c.header != "" {
+		req.Header.Add(c.header,c.value)
+	}
+
+	resp,err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	body,_ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != c.expect {
+		t.Fatalf("incorrect status %d (%d) - %s %s %s",resp.StatusCode,c.expect,c.method,c.url,body)
+	}
+	return string(body)
+}
+
+func do(method,url,header,value string) (int,error) {
+
+	req,err := http.NewRequest(method,url,nil)
+	if err != nil {
+		return -1,err
+	}
+	req.Header.Add(header,value)
+
+	resp,err := client.Do(req)
+	if err != nil {
+		return -1,err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode,nil
+}
+
+func Test_PutKeyExpiry(t *testing.T) {
+
+	ctx,srv := newTestServer(t,"foo")
+	defer srv.Close()
+
+	expires := time.Now().Add(time.Hour).Format(time.RFC3339)
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/foo/bar?ttl=90s",200),
+		asAdmin("PUT","/api/v1/g/foo/baz?ttl=3600",200),
+		asAdmin("PUT","/api/v1/g/foo/qux?expires=" + expires,200),
+		asAdmin("PUT","/api/v1/g/foo/tin?ttl=soon",400),
+		asAdmin("PUT","/api/v1/g/foo/tin?ttl=-5s",400),
+		asAdmin("PUT","/api/v1/g/foo/tin?ttl=5s&expires=" + expires,400))
+
+	r,ok,_ := ctx.GetBucket("foo").GetRecord("bar")
+	if !ok {
+		t.Fatalf("expected record bar")
+	}
+	if d := r.Expires.Sub(r.Created); d != 90 * time.Second {
+		t.Fatalf("expected a 90s ttl, got %v",d)
+	}
+	if ctx.GetBucket("foo").Check("tin") {
+		t.Fatalf("expected no record for tin")
+	}
+}
+
+func Test_GetKeyUses(t *testing.T) {
+
+	ctx,srv := newTestServer(t,"foo")
+	defer srv.Close()
+	api,_ := ctx.IssueApiKey(ApiKeyRecord{Label:"test"},SystemActor)
+
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/foo/bar?uses=2",200),
+		asAdmin("PUT","/api/v1/g/foo/tin?uses=0",400),
+		asAdmin("PUT","/api/v1/g/foo/tin?uses=once",400),
+		asClient(api,"GET","/api/v1/g/foo/bar",200))
+
+	/* an answer for a limited-use record must not be cached */
+	req,_ := http.NewRequest("GET",srv.URL + "/api/v1/g/foo/bar",nil)
+	req.Header.Add("X-ApiKey",api.String())
+	resp,err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected a yes not to be stored, got %d %q",resp.StatusCode,resp.Header.Get("Cache-Control"))
+	}
+
+	run(t,srv,asClient(api,"GET","/api/v1/g/foo/bar",404))
+}
+
+func Test_ApiKeyRegistry(t *testing.T) {
+
+	ctx,srv := newTestServer(t,"foo")
+	defer srv.Close()
+	run(t,srv,asAdmin("PUT","/api/v1/g/foo/bar",200))
+
+	issued := ApiKey(fetch(t,srv,asAdmin("PUT","/api/v1/key?label=gateway",200)))
+	rec,exists,_ := ctx.LookupApiKey(issued)
+	if !exists || rec.Label != "gateway" {
+		t.Fatalf("expected issued key %s to be registered with its label",issued)
+	}
+
+	madeup,_ := GenerateApiKey(DefaultNamespace)
+	imported,_ := GenerateApiKey(DefaultNamespace)
+
+	run(t,srv,
+		asClient(issued,"GET","/api/v1/g/foo/bar",200),
+		asClient(madeup,"GET","/api/v1/g/foo/bar",401),
+		asClient("","GET","/api/v1/g/foo/bar",401),
+		asAdmin("PUT","/api/v1/key/" + imported.String(),200),
+		asClient(imported,"GET","/api/v1/g/foo/bar",200),
+		asAdmin("DELETE","/api/v1/key/" + issued.String(),200),
+		asClient(issued,"GET","/api/v1/g/foo/bar",401),
+
+		/* a revoked key cannot be registered again */
+		asAdmin("PUT","/api/v1/key/" + issued.String(),409),
+		asClient(issued,"GET","/api/v1/g/foo/bar",401))
+}
+
+func Test_ApiKeyScope(t *testing.T) {
+
+	_,srv := newTestServer(t,"login-web","login-app","billing")
+	defer srv.Close()
+	for _,bucket := range []string{"login-web","login-app","billing"} {
+		run(t,srv,asAdmin("PUT","/api/v1/g/" + bucket + "/bar",200))
+	}
+
+	issue := func(query string,expect int) ApiKey {
+		return ApiKey(fetch(t,srv,asAdmin("PUT","/api/v1/key?" + query,expect)))
+	}
+
+	contractor := issue("label=contractor&bucket=login-*&action=check&ttl=1h",200)
+	status := issue("bucket=billing,login-web&action=status",200)
+	issue("action=write",400)
+	issue("ttl=never",400)
+	expired := issue("expires=" + time.Now().Add(-time.Minute).Format(time.RFC3339),200)
+
+	run(t,srv,
+		asClient(contractor,"GET","/api/v1/g/login-web/bar",200),
+		asClient(contractor,"GET","/api/v1/g/login-app/bar",200),
+		asClient(contractor,"GET","/api/v1/g/billing/bar",401),
+		asClient(contractor,"GET","/api/v1/g/login-web",401),
+		asClient(status,"GET","/api/v1/g/billing",200),
+		asClient(status,"GET","/api/v1/g/login-web",200),
+		asClient(status,"GET","/api/v1/g/login-app",401),
+		asClient(status,"GET","/api/v1/g/billing/bar",401),
+
+		/* an expired key is refused everywhere */
+		asClient(expired,"GET","/api/v1/g/billing/bar",401))
+}
+
+func Test_BatchCheck(t *testing.T) {
+
+	ctx,srv := newTestServer(t,"users","emails")
+	defer srv.Close()
+
+	key,_ := ctx.IssueApiKey(ApiKeyRecord{Buckets:[]string{"users","emails","closed","private"}},SystemActor)
+	other,_ := ctx.IssueApiKey(ApiKeyRecord{},SystemActor)
+
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/users/u1",200),
+		asAdmin("PUT","/api/v1/g/emails/e1?uses=1",200),
+		asAdmin("PUT","/api/v1/g/closed",200),
+		asAdmin("PUT","/api/v1/g/closed/c1",200),
+		asAdmin("PUT","/api/v1/g/private?enable=yes&allow=" + other.String(),200),
+		asAdmin("PUT","/api/v1/g/private/p1",200))
+
+	batch := func(api ApiKey,body string) (int,[]CheckPair,string) {
+
+		req,_ := http.NewRequest("POST",srv.URL + "/api/v1/check",bytes.NewBufferString(body))
+		req.Header.Add("X-ApiKey",api.String())
+		resp,err := client.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+
+		var pairs []CheckPair
+		if resp.StatusCode == 200 {
+			if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		return resp.StatusCode,pairs,resp.Header.Get("Cache-Control")
+	}
+
+	body := `[{"bucket":"users","key":"u1"},{"bucket":"users","key":"u2"},{"bucket":"emails","key":"e1"},
+		{"bucket":"emails","key":"e1"},{"bucket":"closed","key":"c1"},{"bucket":"private","key":"p1"},
+		{"bucket":"billing","key":"b1"},{"bucket":"missing","key":"m1"}]`
+	status,pairs,cache := batch(key,body)
+	if status != 200 {
+		t.Fatalf("incorrect status %d",status)
+	}
+	if cache != "no-store" {
+		t.Fatalf("expected a batch consuming a use not to be stored, got %q",cache)
+	}
+	expect := []string{"yes","no","yes","no","unauthorized","unauthorized","unauthorized","unauthorized"}
+	if len(pairs) != len(expect) {
+		t.Fatalf("expected %d results, got %d",len(expect),len(pairs))
+	}
+	for i,p := range pairs {
+		if p.Result != expect[i] {
+			t.Fatalf("incorrect result %s (%s) for %s/%s",p.Result,expect[i],p.Bucket,p.Key)
+		}
+	}
+
+	/* the allow list of a bucket applies per pair */
+	if _,pairs,cache = batch(other,`[{"bucket":"private","key":"p1"}]`); len(pairs) != 1 || pairs[0].Result != "yes" {
+		t.Fatalf("expected p1 in private, got %v",pairs)
+	}
+	if cache != "" {
+		t.Fatalf("expected an unlimited answer to be cacheable, got %q",cache)
+	}
+
+	if status,_,_ = batch(key,`{"bucket":"users"}`); status != 400 {
+		t.Fatalf("expected a malformed batch to be refused, got %d",status)
+	}
+	if status,_,_ = batch(key,`[]`); status != 400 {
+		t.Fatalf("expected an empty batch to be refused, got %d",status)
+	}
+}
+
+/* a failure part way through a batch is reported for that pair alone */
+func Test_BatchCheckError(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx,srv := newTestServer(t)
+	defer srv.Close()
+	p,_ := NewPersister(dir,ctx)
+	api,_ := ctx.IssueApiKey(ApiKeyRecord{},SystemActor)
+
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/users?enable=yes",200),
+		asAdmin("PUT","/api/v1/g/users/once?uses=1",200),
+		asAdmin("PUT","/api/v1/g/users/always",200))
+
+	/* consuming a use needs the journal, checking an unlimited record does not */
+	p.journal.Close()
+
+	req,_ := http.NewRequest("POST",srv.URL + "/api/v1/check",
+		bytes.NewBufferString(`[{"bucket":"users","key":"once"},{"bucket":"users","key":"always"}]`))
+	req.Header.Add("X-ApiKey",api.String())
+	resp,err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+
+	var pairs []CheckPair
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("expected the batch to be answered, got %d %v",resp.StatusCode,err)
+	}
+	if len(pairs) != 2 || pairs[0].Result != ErrorResponse || pairs[1].Result != KeyFoundResponse {
+		t.Fatalf("incorrect results %v",pairs)
+	}
+	if r,ok,_ := ctx.GetBucket("users").GetRecord("once"); !ok || r.Uses != 1 {
+		t.Fatalf("expected the use not to be consumed")
+	}
+}
+
+func Test_ApiKeyRotate(t *testing.T) {
+
+	ctx,srv := newTestServer(t)
+	defer srv.Close()
+	ctx.RotationGrace = time.Hour
+
+	old,_ := ctx.IssueApiKey(ApiKeyRecord{Label:"gateway",Buckets:[]string{"foo"}},SystemActor)
+	other,_ := ctx.IssueApiKey(ApiKeyRecord{Label:"other"},SystemActor)
+
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/foo?enable=yes&allow=" + old.String(),200),
+		asAdmin("PUT","/api/v1/g/foo?allow=" + other.String(),200),
+		asAdmin("PUT","/api/v1/g/foo/bar",200))
+
+	rotate := func(key ApiKey,query string,expect int) ApiKey {
+		return ApiKey(fetch(t,srv,asAdmin("PUT","/api/v1/key/" + key.String() + "/rotate" + query,expect)))
+	}
+	check := func(key ApiKey,expect int) apiCall {
+		return asClient(key,"GET","/api/v1/g/foo/bar",expect)
+	}
+
+	next := rotate(old,"",200)
+	run(t,srv,check(next,200),check(old,200)) /* within the grace period */
+	rotate(old,"",409)
+	madeup,_ := GenerateApiKey(DefaultNamespace)
+	rotate(madeup,"",404)
+
+	rec,_,_ := ctx.LookupApiKey(next)
+	if rec.Label != "gateway" || len(rec.Buckets) != 1 || rec.Buckets[0] != "foo" {
+		t.Fatalf("expected successor to inherit label and scope, got %+v",rec)
+	}
+
+	/* no grace, the old key stops at once and the sweeper revokes it */
+	last := rotate(next,"?grace=0s",200)
+	run(t,srv,check(next,401),check(last,200))
+	if n := ctx.SweepApiKeys(); n != 1 {
+		t.Fatalf("expected 1 rotated key revoked, got %d",n)
+	}
+	for _,k := range ctx.GetBucket("foo").ApiKeys() {
+		if k == next {
+			t.Fatalf("expected revoked key to leave the access list")
+		}
+	}
+	run(t,srv,check(other,200))
+	rotate(next,"",409)
+}
+
+func Test_AdminRoles(t *testing.T) {
+
+	ctx := NewContext()
+	ctx.Admins.Add("root",RoleAdmin,"root-key")
+	ctx.Admins.Add("provisioner",RoleOperator,"operator-key")
+	ctx.Admins.Add("compliance",RoleAuditor,"auditor-key")
+	srv := testServer(ctx)
+	defer srv.Close()
+
+	run(t,srv,
+		apiCall{"PUT","/api/v1/g/foo?enable=yes","X-AdminKey","root-key",200},
+		apiCall{"PUT","/api/v1/g/foo/bar","X-AdminKey","operator-key",200},
+		apiCall{"DELETE","/api/v1/g/foo/bar","X-AdminKey","operator-key",200},
+		apiCall{"PUT","/api/v1/g/soap","X-AdminKey","operator-key",403},
+		apiCall{"PUT","/api/v1/key","X-AdminKey","operator-key",403},
+		apiCall{"GET","/api/v1/g","X-AdminKey","operator-key",200},
+		apiCall{"GET","/api/v1/g","X-AdminKey","auditor-key",200},
+		apiCall{"GET","/api/v1/key","X-AdminKey","auditor-key",200},
+		apiCall{"PUT","/api/v1/g/foo/bar","X-AdminKey","auditor-key",403},
+		apiCall{"DELETE","/api/v1/g/foo","X-AdminKey","auditor-key",403},
+		apiCall{"GET","/api/v1/g","X-AdminKey","wrong-key",401},
+		apiCall{"PUT","/api/v1/g/foo/bar","X-AdminKey","",401})
+}
+
+func Test_Status(t *testing.T) {
+
+	ctx := NewContext()
+	ctx.AddBucket("foo")
+	srv := testServer(ctx)
+	defer srv.Close()
+
+	/* before loading */
+	run(t,srv,
+		apiCall{"GET","/api/v1/status","","",200},
+		apiCall{"GET","/api/v1/status/","","",200},
+		apiCall{"GET","/api/v1/status/ready","","",503},
+		apiCall{"GET","/api/v1/status/detail/","","",503})
+
+	ctx.Health.SetLoaded()
+	run(t,srv,apiCall{"GET","/api/v1/status/ready/","","",200})
+
+	ctx.Health.AddCheck("storage",func() error { return errors.New("read only") })
+	var detail struct {
+		Status string `json:"status"`
+		Version string `json:"version"`
+		Buckets int `json:"buckets"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal([]byte(fetch(t,srv,apiCall{"GET","/api/v1/status/detail","","",503})),&detail); err != nil {
+		t.Fatal(err.Error())
+	}
+	if detail.Status != StatusNotReadyResponse {
+		t.Fatalf("expected not ready with a failing check, got %s",detail.Status)
+	}
+	if detail.Version != Version || detail.Buckets != 1 {
+		t.Fatalf("incorrect detail %+v",detail)
+	}
+	if detail.Checks["loaded"] != StatusOkResponse || detail.Checks["storage"] != "read only" {
+		t.Fatalf("incorrect checks %v",detail.Checks)
+	}
+}
+
 func Test_AddBucket(t *testing.T) {
 
 	status,msg,err := adminRequest(add("foo"))
@@ -0,0 +1,406 @@
+/* authd/authd/audit.go */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditAdmin = "admin"
+	AuditCheck = "check"
+
+	MinAuditKey = 16 /* bytes */
+)
+
+var (
+	AuditChainBroken = errors.New("Audit Chain Broken")
+	AuditTruncated = errors.New("Audit Log Truncated")
+	AuditHeadMissing = errors.New("Audit Head Missing")
+	AuditKeyInvalid = errors.New("Invalid Audit Key")
+	AuditFailing = errors.New("Audit Log Failing")
+
+	/* SystemActor - changes authd makes on its own, e.g. revoking rotated Api Keys */
+	SystemActor = Actor{Name:"authd"}
+)
+
+/* Actor - who an audited change or check was made by, an admin credential or a client's Api Key */
+type Actor struct {
+
+	Name string `json:"name,omitempty"`
+	Role Role `json:"role,omitempty"`
+	ApiKey string `json:"api_key,omitempty"` /* redacted */
+	Remote string `json:"remote,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+/* ActorOf - the admin (if any) a request was made by, where it came from and its request id */
+func ActorOf(req *http.Request) Actor {
+
+	a := Actor{Remote:req.RemoteAddr,RequestID:RequestID(req)}
+	if cred,ok := AdminOf(req); ok {
+		a.Name = cred.Name
+		a.Role = cred.Role
+	}
+	return a
+}
+
+/* ClientActor - a client request made with key */
+func ClientActor(req *http.Request,key ApiKey) Actor {
+
+	a := ActorOf(req)
+	a.ApiKey = Redact.ApiKey(key)
+	return a
+}
+
+/* AuditEntry - one line of the audit log, Hash is an HMAC of the entry including Prev (the hash of
+ * the entry before) so no entry can be edited, dropped or reordered without breaking the chain, and
+ * the chain cannot be rebuilt without the key */
+type AuditEntry struct {
+
+	Seq uint64 `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string `json:"kind"` /* AuditAdmin or AuditCheck */
+	By Actor `json:"by"`
+	Op string `json:"op,omitempty"`
+	Bucket Key `json:"bucket,omitempty"`
+	Key string `json:"key,omitempty"` /* redacted */
+	ApiKey string `json:"api_key,omitempty"` /* redacted */
+	Old interface{} `json:"old,omitempty"` /* state before an admin change, absent if there was none */
+	New interface{} `json:"new,omitempty"` /* and after */
+	Result string `json:"result,omitempty"` /* of a check, yes, no or unauthorized */
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"` /* always last */
+}
+
+/* AuditLog - append-only, fsync'd and hash-chained log of admin changes and (optionally) client checks,
+ * chained with a key kept apart from the log */
+type AuditLog struct {
+
+	mu sync.Mutex
+	f *os.File
+	path string
+	key []byte
+	seq uint64
+	head string
+
+	failedMu sync.Mutex /* kept apart from mu so Ping never waits on a write */
+	failed error
+
+	Checks bool /* record every client check decision as well */
+}
+
+/* OpenAuditLog - open (or create) the log at path chained with key, an existing log is verified
+ * first and is never extended if its chain is broken. A torn last line, left by a crash part way
+ * through a write, is dropped as the journal does */
+func OpenAuditLog(path string,key []byte,checks bool) (*AuditLog,error) {
+
+	if len(key) < MinAuditKey {
+		return nil,AuditKeyInvalid
+	}
+
+	seq,head,size,err := verifyAudit(path,key,"")
+	if errors.Is(err,AuditTruncated) {
+		Log.Warn("audit log truncated","path",path,"entries",seq,"error",err)
+		err = os.Truncate(path,size)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil,err
+	}
+
+	f,err := os.OpenFile(path,os.O_CREATE|os.O_WRONLY|os.O_APPEND,0600)
+	if err != nil {
+		return nil,err
+	}
+	return &AuditLog{f:f,path:path,key:append([]byte(nil),key...),seq:seq,head:head,Checks:checks},nil
+}
+
+/* Append - chain e to the log and write it to disk. Once a write has failed nothing more is written,
+ * it may have left part of a line that later entries would be chained after, reopening drops it */
+func (a *AuditLog) Append(e AuditEntry) error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.Ping(); err != nil {
+		return err
+	}
+	return a.setFailed(a.append(e))
+}
+
+func (a *AuditLog) append(e AuditEntry) error {
+
+	e.Seq = a.seq + 1
+	e.Prev = a.head
+	e.Hash = ""
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	body,err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	hash := auditHash(a.key,body)
+	line := append(body[:len(body) - 1],[]byte(`,"hash":"` + hash + "\"}\n")...)
+
+	if _,err := a.f.Write(line); err != nil {
+		return err
+	}
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	a.seq = e.Seq
+	a.head = hash
+	return nil
+}
+
+func (a *AuditLog) setFailed(err error) error {
+
+	a.failedMu.Lock()
+	defer a.failedMu.Unlock()
+	a.failed = err
+	return err
+}
+
+/* Ping - the error of the append that failed, entries are no longer written once one has */
+func (a *AuditLog) Ping() error {
+
+	a.failedMu.Lock()
+	defer a.failedMu.Unlock()
+	return a.failed
+}
+
+/* Head - the sequence number and hash of the last entry, record it elsewhere to detect truncation */
+func (a *AuditLog) Head() (uint64,string) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seq,a.head
+}
+
+/* Check - record a client check decision, if checks are audited */
+func (a *AuditLog) Check(by Actor,bucket Key,result string) {
+
+	if a == nil || !a.Checks {
+		return
+	}
+	if err := a.Append(AuditEntry{Kind:AuditCheck,By:by,Bucket:bucket,Result:result}); err != nil {
+		Log.Error("audit failed","path",a.path,"error",err)
+	}
+}
+
+func (a *AuditLog) Close() error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+func auditHash(key,body []byte) string {
+
+	mac := hmac.New(sha256.New,key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/* LoadAuditKey - read the key the audit log is chained with from a file, surrounding whitespace is
+ * ignored. Keep it apart from the log, whoever holds it can rewrite the chain */
+func LoadAuditKey(path string) ([]byte,error) {
+
+	key,err := LoadHashSecret(path)
+	if err != nil {
+		return nil,err
+	}
+	if len(key) < MinAuditKey {
+		return nil,AuditKeyInvalid
+	}
+	return key,nil
+}
+
+/* VerifyAudit - walk the chain at path with key, returning the number of entries and the last hash.
+ * If head is given (a hash recorded earlier) it must still be in the chain, otherwise the log has
+ * been cut back past it - entries cut off the end are only detected this way */
+func VerifyAudit(path string,key []byte,head string) (uint64,string,error) {
+
+	seq,last,_,err := verifyAudit(path,key,head)
+	return seq,last,err
+}
+
+/* verifyAudit - as VerifyAudit, also returning the size of the verified part of the log */
+func verifyAudit(path string,key []byte,head string) (uint64,string,int64,error) {
+
+	f,err := os.Open(path)
+	if err != nil {
+		return 0,"",0,err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var seq uint64
+	var size int64
+	prev := ""
+	found := head == ""
+	for {
+
+		line,err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return seq,prev,size,fmt.Errorf("%s:%d %w",path,seq + 1,AuditTruncated)
+			}
+			break
+		}
+		if err != nil {
+			return seq,prev,size,err
+		}
+
+		var e AuditEntry
+		if err := json.Unmarshal(line,&e); err != nil {
+			return seq,prev,size,fmt.Errorf("%s:%d %v (%v)",path,seq + 1,AuditChainBroken,err)
+		}
+
+		suffix := []byte(`,"hash":"` + e.Hash + "\"}\n")
+		if e.Hash == "" || !bytes.HasSuffix(line,suffix) {
+			return seq,prev,size,fmt.Errorf("%s:%d %v (no hash)",path,seq + 1,AuditChainBroken)
+		}
+		body := append(line[:len(line) - len(suffix)],'}')
+
+		switch {
+		case e.Seq != seq + 1:
+			return seq,prev,size,fmt.Errorf("%s:%d %v (sequence %d)",path,seq + 1,AuditChainBroken,e.Seq)
+		case e.Prev != prev:
+			return seq,prev,size,fmt.Errorf("%s:%d %v (previous hash)",path,seq + 1,AuditChainBroken)
+		case !hmac.Equal([]byte(auditHash(key,body)),[]byte(e.Hash)):
+			return seq,prev,size,fmt.Errorf("%s:%d %v (hash)",path,seq + 1,AuditChainBroken)
+		}
+
+		seq = e.Seq
+		prev = e.Hash
+		size += int64(len(line))
+		if e.Hash == head {
+			found = true
+		}
+	}
+
+	if !found {
+		return seq,prev,size,AuditHeadMissing
+	}
+	return seq,prev,size,nil
+}
+
+/* bucketState - what the audit log records of a bucket */
+type bucketState struct {
+
+	Live bool `json:"live"`
+	Hashed bool `json:"hashed"`
+	ApiKeys []string `json:"api_keys"` /* redacted */
+}
+
+type recordState struct {
+
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"` /* zero for never */
+	Uses int `json:"uses,omitempty"`
+}
+
+/* auditState - the state of what m changes, nil if it does not exist */
+func (ctx *Context) auditState(m Mutation) interface{} {
+
+	switch m.Op {
+	case OpIssueApiKey,OpUpdateApiKey,OpRevokeApiKeyGlobal:
+
+		rec,exists,err := ctx.store.ApiKey(m.ApiKey)
+		if err != nil || !exists {
+			return nil
+		}
+		rec.Key = ApiKey(Redact.ApiKey(rec.Key))
+		if rec.RotatedTo != "" {
+			rec.RotatedTo = ApiKey(Redact.ApiKey(rec.RotatedTo))
+		}
+		return rec
+	}
+
+	b := ctx.GetBucket(m.Bucket)
+	if b == nil {
+		return nil
+	}
+
+	switch m.Op {
+	case OpSetKey,OpDelKey:
+
+		r,exists,err := b.store.Get(m.Key)
+		if err != nil || !exists {
+			return nil
+		}
+		return recordState{r.Created,r.Expires,r.Uses}
+	}
+
+	live,err := b.IsLive()
+	if err != nil {
+		Log.Error("storage error","bucket",b.Name,"error",err)
+	}
+	s := bucketState{Live:live,Hashed:b.IsHashed(),ApiKeys:make([]string,0)}
+	for _,k := range b.ApiKeys() {
+		s.ApiKeys = append(s.ApiKeys,Redact.ApiKey(k))
+	}
+	return s
+}
+
+/* auditEntry - the entry for m just applied, old is the state captured before */
+func (ctx *Context) auditEntry(m Mutation,old interface{}) AuditEntry {
+
+	e := AuditEntry{Kind:AuditAdmin,Time:m.Time,By:m.By,Op:m.Op,Bucket:m.Bucket,Old:old,New:ctx.auditState(m)}
+	if m.Key != "" {
+		e.Key = Redact.Key(m.Key)
+	}
+	if m.ApiKey != "" {
+		e.ApiKey = Redact.ApiKey(m.ApiKey)
+	}
+	return e
+}
+
+/* auditMain - authd audit verify -key file [-head hash] path, exits 0 if the chain is intact */
+func auditMain(args []string) int {
+
+	fs := flag.NewFlagSet("audit verify",flag.ContinueOnError)
+	keyFile := fs.String("key","","file holding the key the log is chained with, as given to -audit-key")
+	head := fs.String("head","","hash of an entry recorded earlier, the log must still reach it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),"usage: authd audit verify -key file [-head hash] audit-log")
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 || args[0] != "verify" {
+		fs.Usage()
+		return 2
+	}
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 || *keyFile == "" {
+		fs.Usage()
+		return 2
+	}
+
+	key,err := LoadAuditKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr,"audit verify failed:",err)
+		return 1
+	}
+	seq,last,err := VerifyAudit(fs.Arg(0),key,*head)
+	if err != nil {
+		fmt.Fprintln(os.Stderr,"audit verify failed:",err)
+		return 1
+	}
+	fmt.Fprintln(os.Stdout,"ok",seq,"entries, head",last)
+	return 0
+}
@@ -0,0 +1,252 @@
+/* authd/authd/audit_test.go */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	testAuditKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func readAudit(t *testing.T,path string) []AuditEntry {
+
+	f,err := os.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	entries := make([]AuditEntry,0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(),&e); err != nil {
+			t.Fatal(err.Error())
+		}
+		entries = append(entries,e)
+	}
+	return entries
+}
+
+func Test_AuditChain(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir,"audit.log")
+
+	if _,err := OpenAuditLog(path,[]byte("short"),true); err != AuditKeyInvalid {
+		t.Fatalf("expected a short key to be refused, got %v",err)
+	}
+	a,err := OpenAuditLog(path,testAuditKey,true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _,result := range []string{KeyFoundResponse,KeyNotFoundResponse,UnauthorizedResponse} {
+		a.Check(Actor{ApiKey:"7460..8455"},"users",result)
+	}
+	a.Close()
+
+	/* reopening carries on the chain */
+	a,err = OpenAuditLog(path,testAuditKey,true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a.Check(Actor{ApiKey:"7460..8455"},"users",KeyFoundResponse)
+	seq,head := a.Head()
+	a.Close()
+
+	if n,last,err := VerifyAudit(path,testAuditKey,head); err != nil || n != 4 || n != seq || last != head {
+		t.Fatalf("expected an intact chain of 4, got %d %s %v",n,last,err)
+	}
+
+	good,_ := ioutil.ReadFile(path)
+	lines := bytes.SplitAfter(good,[]byte("\n"))
+
+	/* an edited log chained again without the key */
+	forgedPath := filepath.Join(dir,"forged.log")
+	forger,_ := OpenAuditLog(forgedPath,[]byte("not-the-audit-key"),true)
+	for _,result := range []string{KeyFoundResponse,KeyFoundResponse,UnauthorizedResponse,KeyFoundResponse} {
+		forger.Check(Actor{ApiKey:"7460..8455"},"users",result)
+	}
+	forger.Close()
+	forged,_ := ioutil.ReadFile(forgedPath)
+	for _,c := range []struct {
+		name string
+		data []byte
+		expect error
+	}{
+		{"edited",bytes.Replace(good,[]byte(`"result":"no"`),[]byte(`"result":"yes"`),1),AuditChainBroken},
+		{"dropped",bytes.Join([][]byte{lines[0],lines[2],lines[3]},nil),AuditChainBroken},
+		{"reordered",bytes.Join([][]byte{lines[1],lines[0],lines[2],lines[3]},nil),AuditChainBroken},
+		{"cut short",good[:len(good) - 10],AuditTruncated},
+		{"cut back",bytes.Join(lines[:3],nil),AuditHeadMissing},
+		{"forged",forged,AuditChainBroken}} {
+
+		ioutil.WriteFile(path,c.data,0600)
+		if _,_,err := VerifyAudit(path,testAuditKey,head); err == nil || !strings.Contains(err.Error(),c.expect.Error()) {
+			t.Fatalf("expected %s log to fail with %v, got %v",c.name,c.expect,err)
+		}
+	}
+
+	/* a broken log is never extended */
+	ioutil.WriteFile(path,bytes.Replace(good,[]byte(`"result":"no"`),[]byte(`"result":"yes"`),1),0600)
+	if _,err := OpenAuditLog(path,testAuditKey,true); err == nil {
+		t.Fatalf("expected a broken log to be refused")
+	}
+
+	/* a torn last line is dropped and the chain carries on from the entry before */
+	ioutil.WriteFile(path,good[:len(good) - 10],0600)
+	a,err = OpenAuditLog(path,testAuditKey,true)
+	if err != nil {
+		t.Fatalf("expected a torn last line to be dropped, got %v",err)
+	}
+	a.Check(Actor{ApiKey:"7460..8455"},"users",KeyFoundResponse)
+	a.Close()
+	if n,_,err := VerifyAudit(path,testAuditKey,""); err != nil || n != 4 {
+		t.Fatalf("expected an intact chain of 4, got %d %v",n,err)
+	}
+
+	keyFile := filepath.Join(dir,"audit.key")
+	ioutil.WriteFile(keyFile,append(testAuditKey,'\n'),0600)
+	ioutil.WriteFile(path,good,0600)
+	if status := auditMain([]string{"verify","-key",keyFile,"-head",head,path}); status != 0 {
+		t.Fatalf("expected audit verify to pass, got %d",status)
+	}
+	ioutil.WriteFile(path,lines[0],0600)
+	if status := auditMain([]string{"verify","-key",keyFile,"-head",head,path}); status != 1 {
+		t.Fatalf("expected audit verify to fail, got %d",status)
+	}
+	if status := auditMain([]string{"verify","-key",forgedPath,path}); status != 1 {
+		t.Fatalf("expected the wrong key to fail, got %d",status)
+	}
+	for _,args := range [][]string{{"check",path},{"verify",path}} {
+		if status := auditMain(args); status != 2 {
+			t.Fatalf("expected a usage error for %v, got %d",args,status)
+		}
+	}
+}
+
+/* admin changes are audited with who made them and the state before and after, checks when asked */
+func Test_AuditAdmin(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir,"audit.log")
+
+	ctx := NewContext()
+	ctx.Admins.Add("alice",RoleAdmin,DefaultAdminKey)
+	if ctx.Audit,err = OpenAuditLog(path,testAuditKey,true); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ctx.Audit.Close()
+
+	api,_ := ctx.IssueApiKey(ApiKeyRecord{Label:"gateway"},SystemActor)
+
+	srv := testServer(ctx)
+	defer srv.Close()
+	for _,c := range []struct {
+		method,url,header,value string
+		expect int
+	}{
+		{"PUT","/api/v1/g/users?enable=yes","X-AdminKey",DefaultAdminKey,200},
+		{"PUT","/api/v1/g/users?allow=" + api.String(),"X-AdminKey",DefaultAdminKey,200},
+		{"PUT","/api/v1/g/users/alice@example.com?uses=2","X-AdminKey",DefaultAdminKey,200},
+		{"GET","/api/v1/g/users/alice@example.com","X-ApiKey",api.String(),200},
+		{"GET","/api/v1/g/users/bob@example.com","X-ApiKey",api.String(),404},
+		{"GET","/api/v1/g/users/bob@example.com","X-ApiKey","74602730-7230-5d67-7d60-0400c67e8455",401},
+		{"DELETE","/api/v1/g/users/alice@example.com","X-AdminKey",DefaultAdminKey,200}} {
+
+		if status,_ := do(c.method,srv.URL + c.url,c.header,c.value); status != c.expect {
+			t.Fatalf("incorrect status %d (%d) - %s %s",status,c.expect,c.method,c.url)
+		}
+	}
+
+	if _,_,err := VerifyAudit(path,testAuditKey,""); err != nil {
+		t.Fatal(err.Error())
+	}
+	data,_ := ioutil.ReadFile(path)
+	if strings.Contains(string(data),"alice@example.com") || strings.Contains(string(data),api.String()) {
+		t.Fatalf("expected keys and api keys to be redacted in the audit log")
+	}
+
+	entries := readAudit(t,path)
+	ops := make([]string,0)
+	for _,e := range entries {
+		ops = append(ops,e.Kind + ":" + e.Op + e.Result)
+	}
+	/* a single put applies its changes in no particular order, so enable and allow come apart */
+	expect := "admin:apikey.issue admin:bucket.set admin:bucket.enable admin:bucket.set admin:bucket.allow admin:key.set " +
+		"admin:key.set check:yes check:no check:unauthorized admin:key.del"
+	if got := strings.Join(ops," "); got != expect {
+		t.Fatalf("incorrect audit entries\n%s\n%s",got,expect)
+	}
+
+	/* the put, by alice with no record before, then the use by the gateway leaving 1 */
+	put,use,del := entries[5],entries[6],entries[10]
+	if put.By.Name != "alice" || put.By.Role != RoleAdmin || put.By.RequestID == "" || put.Old != nil || put.New == nil {
+		t.Fatalf("incorrect put entry %+v",put)
+	}
+	if use.By.ApiKey != api.Obf() || use.Old.(map[string]interface{})["uses"] != float64(2) ||
+		use.New.(map[string]interface{})["uses"] != float64(1) {
+		t.Fatalf("incorrect use entry %+v",use)
+	}
+	if del.Old == nil || del.New != nil {
+		t.Fatalf("incorrect delete entry %+v",del)
+	}
+	enable := entries[2]
+	if enable.Old.(map[string]interface{})["live"] != false || enable.New.(map[string]interface{})["live"] != true {
+		t.Fatalf("incorrect enable entry %+v",enable)
+	}
+	if entries[0].By.Name != SystemActor.Name {
+		t.Fatalf("incorrect issue entry %+v",entries[0])
+	}
+}
+
+/* a change that cannot be audited fails its request and the service stops reporting ready */
+func Test_AuditFailure(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx,srv := newTestServer(t)
+	defer srv.Close()
+	if ctx.Audit,err = OpenAuditLog(filepath.Join(dir,"audit.log"),testAuditKey,false); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx.Health.AddCheck("audit",ctx.Audit.Ping)
+	ctx.Health.SetLoaded()
+
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/users",200),
+		apiCall{"GET","/api/v1/status/ready","","",200})
+
+	/* alice is set though she cannot be audited, nothing is set after her */
+	ctx.Audit.Close()
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/users/alice",200),
+		apiCall{"GET","/api/v1/status/ready","","",503},
+		asAdmin("PUT","/api/v1/g/users/bob",500))
+	if ctx.Audit.Ping() == nil {
+		t.Fatalf("expected the audit log to report the failed append")
+	}
+	if b := ctx.GetBucket("users"); !b.Check("alice") || b.Check("bob") {
+		t.Fatalf("expected alice set and bob refused")
+	}
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"time"
 	"errors"
+	"sync"
 )
 
 var (
@@ -16,19 +17,39 @@ var (
 type Record struct {
 
 	Created time.Time  /* when the record was added */
+	Expires time.Time  /* zero for never */
+	Uses int  /* remaining uses, zero for unlimited */
 } 
 
+/* Expired - has the record passed its expiry time at t */
+func (r Record) Expired(t time.Time) bool {
+
+	return !r.Expires.IsZero() && !t.Before(r.Expires)
+}
+
 type Bucket struct {
 
 	Name Key
-	live bool   /* is the bucket enabled, viewable to clients */
-	ApiKeyList []ApiKey    /* basic Access Control List, all keys on list are accepted */
-	Records map[Key]Record
+	store BucketStorage /* records, live state and the basic Access Control List, all keys on list are accepted */
+	hasher *Hasher /* digests record keys once the bucket is hashed, nil if it cannot be */
+
+	mu sync.Mutex /* serialises read-modify-write of the store */
+}
+
+/* ApiKeys - a copy of the bucket access list */
+func (b *Bucket) ApiKeys() []ApiKey {
+
+	keys,err := b.store.ApiKeys()
+	if err != nil {
+		Log.Error("storage error","bucket",b.Name,"error",err)
+		return make([]ApiKey,0)
+	}
+	return keys
 }
 
 func (b *Bucket) HasGlobalAccess() bool {
 
-	if len(b.ApiKeyList) == 0 {
+	if len(b.ApiKeys()) == 0 {
 		return true
 	}
 	return false
@@ -40,14 +61,24 @@ func (b *Bucket) AllowApiKey(key ApiKey) (bool,error) {
 		return false,KeyInvalid
 	}
 
-	for _,k := range b.ApiKeyList {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys,err := b.store.ApiKeys()
+	if err != nil {
+		return false,err
+	}
+
+	for _,k := range keys {
 		
 		if key == k {
 			return false,ApiKeyAlreadyPresent
 		}
 	}
 
-	b.ApiKeyList = append(b.ApiKeyList,key)
+	if err := b.store.SetApiKeys(append(keys,key)); err != nil {
+		return false,err
+	}
 	return true,nil
 }
 
@@ -57,10 +88,18 @@ func (b *Bucket) RevokeApiKey(key ApiKey) (bool,error) {
 		return false,KeyInvalid
 	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current,err := b.store.ApiKeys()
+	if err != nil {
+		return false,err
+	}
+
 	keys := make([]ApiKey,0)
 	found := false
 	
-	for _,k := range b.ApiKeyList {
+	for _,k := range current {
 
 		if key != k {
 			
@@ -74,23 +113,39 @@ func (b *Bucket) RevokeApiKey(key ApiKey) (bool,error) {
 		return false,ApiKeyNotFound
 	}
 
-	b.ApiKeyList = keys
+	if err := b.store.SetApiKeys(keys); err != nil {
+		return false,err
+	}
 	return true,nil
 }
 
 
 func (b *Bucket) RevokeAllApiKeys() {
 
-	b.ApiKeyList = make([]ApiKey,0)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.store.SetApiKeys(make([]ApiKey,0)); err != nil {
+		Log.Error("storage error","bucket",b.Name,"error",err)
+	}
 }
 
 func (b *Bucket) Allowed(api ApiKey) (bool,error) {
 
-	if ! b.IsLive() {
+	live,err := b.IsLive()
+	if err != nil {
+		return false,err
+	}
+	if !live {
 		return false,BucketNotLive
 	}
 
-	if len(b.ApiKeyList) == 0 {
+	keys,err := b.store.ApiKeys()
+	if err != nil {
+		return false,err
+	}
+
+	if len(keys) == 0 {
 		return true,nil
 	}
 
@@ -98,7 +153,7 @@ func (b *Bucket) Allowed(api ApiKey) (bool,error) {
 		return false,KeyInvalid
 	}
 
-	for _,k := range b.ApiKeyList {
+	for _,k := range keys {
 
 		if k == api {
 			return true,nil
@@ -108,62 +163,213 @@ func (b *Bucket) Allowed(api ApiKey) (bool,error) {
 }
 			
 
+/* Add - add a key if it is not already present. The key is hashed and written under the same lock as
+ * Hash so a bucket being hashed never gets a plaintext key */
 func (b *Bucket) Add(key Key) bool {
 
-	if b.Check(key) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored,err := b.StoredKey(key)
+	if err != nil {
 		return false
 	}
-
-	b.Records[key] = Record{time.Now()}
-	return true
+	r,exists,err := b.store.Get(stored)
+	if err != nil || (exists && !r.Expired(time.Now())) {
+		return false
+	}
+	return b.store.Put(stored,Record{Created:time.Now()}) == nil
 }
 
 func (b *Bucket) Set(key Key) bool {
 
-	b.Records[key] = Record{time.Now()}
-	return true
+	return b.SetRecord(key,Record{Created:time.Now()}) == nil
+}
+
+/* SetRecord - put a record under key, hashed under the same lock as Hash */
+func (b *Bucket) SetRecord(key Key,r Record) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored,err := b.StoredKey(key)
+	if err != nil {
+		return err
+	}
+	return b.store.Put(stored,r)
+}
+
+/* setStored - put a record under the key as stored, i.e. already hashed if the bucket is */
+func (b *Bucket) setStored(stored Key,r Record) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.store.Put(stored,r)
 }
 
 func (b *Bucket) Del(key Key) bool {
 
-	if !b.Check(key) {
-		return false
+	found,err := b.DelRecord(key)
+	return found && err == nil
+}
+
+/* DelRecord - remove the record under key, hashed under the same lock as Hash */
+func (b *Bucket) DelRecord(key Key) (bool,error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored,err := b.StoredKey(key)
+	if err != nil {
+		return false,err
+	}
+	return b.store.Del(stored)
+}
+
+func (b *Bucket) delStored(stored Key) (bool,error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.store.Del(stored)
+}
+
+/* GetRecord - fetch a live record, expired records are treated as not found */
+func (b *Bucket) GetRecord(key Key) (Record,bool,error) {
+
+	stored,err := b.StoredKey(key)
+	if err != nil {
+		return Record{},false,err
+	}
+
+	r,exists,err := b.store.Get(stored)
+	if err != nil || !exists || r.Expired(time.Now()) {
+		return Record{},false,err
 	}
-	delete(b.Records,key)
-	return true
+	return r,true,nil
 }
 
+/* Check - is there a live record for key, storage failures are logged and treated as not found */
 func (b *Bucket) Check(key Key) bool {
 
-	if _,exists := b.Records[key]; !exists {
-		
+	_,exists,err := b.GetRecord(key)
+	if err != nil {
+		Log.Error("storage error","bucket",b.Name,"error",err)
+	}
+	return exists
+}
+
+/* StoredKey - the key a record is stored under, its digest in a hashed bucket */
+func (b *Bucket) StoredKey(key Key) (Key,error) {
+
+	stored,_,err := b.storedKey(key)
+	return stored,err
+}
+
+/* storedKey - as StoredKey, also whether the bucket is hashed */
+func (b *Bucket) storedKey(key Key) (Key,bool,error) {
+
+	hashed,err := b.store.Hashed()
+	if err != nil || !hashed {
+		return key,false,err
+	}
+	digest,err := b.hasher.Sum(b.Name,key)
+	return digest,true,err
+}
+
+func (b *Bucket) IsHashed() bool {
+
+	hashed,err := b.store.Hashed()
+	if err != nil {
+		Log.Error("storage error","bucket",b.Name,"error",err)
 		return false
 	}
-	return true
+	return hashed
 }
 
-func (b *Bucket) IsLive() bool {
-	return b.live
+/* Hash - switch the bucket to hashed records, replacing the key of every record with its digest in
+ * one step, there is no way back. Hashing a hashed bucket hashes any plaintext key left in it, by an
+ * interrupted conversion, a digest already held is kept as it is the record that has been served */
+func (b *Bucket) Hash() error {
+
+	if !b.hasher.Ready() {
+		return HashSecretMissing
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hashed,err := b.store.Hashed()
+	if err != nil {
+		return err
+	}
+	return b.store.HashKeys(func(k Key) (Key,error) {
+		if hashed && isDigest(k) {
+			return k,nil
+		}
+		return b.hasher.Sum(b.Name,k)
+	})
+}
+
+/* Each - visit every record in the bucket, by stored key */
+func (b *Bucket) Each(fn func(Key,Record) error) error {
+
+	return b.store.Each(fn)
+}
+
+/* Expired - the stored keys of every record expired at t */
+func (b *Bucket) Expired(t time.Time) ([]Key,error) {
+
+	expired := make([]Key,0)
+	err := b.store.Each(func(k Key,r Record) error {
+		if r.Expired(t) {
+			expired = append(expired,k)
+		}
+		return nil
+	})
+	return expired,err
+}
+
+func (b *Bucket) IsLive() (bool,error) {
+
+	return b.store.Live()
+}
+
+func (b *Bucket) SetLive(live bool) error {
+	return b.store.SetLive(live)
 }
 
 func (b *Bucket) Enable() {
-	b.live = true
+	b.SetLive(true)
 }
 
 func (b *Bucket) Disable() {
-	b.live = false
+	b.SetLive(false)
+}
+
+func (b *Bucket) Len() (int,error) {
+
+	return b.store.Len()
 }
 
-func (b *Bucket) IsEmpty() bool {
-	return (len(b.Records) == 0)
+func (b *Bucket) IsEmpty() (bool,error) {
+
+	return b.store.Empty()
 }
 
+/* NewBucket - a standalone bucket held in memory */
 func NewBucket(name Key) *Bucket {
 
+	store,_ := NewMemoryStorage().Create(name)
+	return newBucket(name,store,nil)
+}
+
+func newBucket(name Key,store BucketStorage,hasher *Hasher) *Bucket {
+
 	b := new(Bucket)
 	b.Name = name
-	b.Records = make(map[Key]Record,0)
-	b.ApiKeyList = make([]ApiKey,0)
-	b.live = false
+	b.store = store
+	b.hasher = hasher
 	return b
 }
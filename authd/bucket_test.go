@@ -3,6 +3,7 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
 const (
@@ -68,4 +69,41 @@ func Test_GlobalAccess(t *testing.T) {
 		t.Fatalf("expected not to have global access")
 	}
 }
-	
+
+func Test_RecordExpiry(t *testing.T) {
+
+	b := NewBucket("foo")
+	now := time.Now()
+
+	b.SetRecord("bar",Record{Created:now,Expires:now.Add(-time.Second)})
+	b.SetRecord("soap",Record{Created:now,Expires:now.Add(time.Hour)})
+	b.Set("tin")
+
+	if b.Check("bar") {
+		t.Fatalf("expected expired record to be absent")
+	}
+	if !b.Check("soap") || !b.Check("tin") {
+		t.Fatalf("expected unexpired records to be present")
+	}
+	if !b.Add("bar") {
+		t.Fatalf("expected add over an expired record to work")
+	}
+}
+
+func Test_Sweep(t *testing.T) {
+
+	ctx := NewContext()
+	b,_ := ctx.AddBucket("foo")
+	now := time.Now()
+
+	b.SetRecord("bar",Record{Created:now,Expires:now.Add(-time.Second)})
+	b.SetRecord("soap",Record{Created:now,Expires:now.Add(time.Hour)})
+	b.Set("tin")
+
+	if n := ctx.Sweep(); n != 1 {
+		t.Fatalf("expected 1 record swept, got %d",n)
+	}
+	if n,_ := b.Len(); n != 2 {
+		t.Fatalf("expected 2 records to remain, got %d",n)
+	}
+}
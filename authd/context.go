@@ -1,12 +1,38 @@
 package main
 
-
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 type Context struct {
 
-	AdminKey string
+	Admins *AdminSet
+	Certs *CertIdentities /* client certificates standing in for Api Keys and admin keys */
 	Namespace string
-	Buckets map[Key]*Bucket
+	Health *Health
+	Hasher *Hasher /* secret for hashed buckets */
+	Audit *AuditLog /* nil when not auditing */
+	Metrics *Metrics
+	RotationGrace time.Duration /* default overlap when rotating an Api Key */
+
+	mu sync.RWMutex /* guards buckets, held for the lifetime of compound changes */
+	buckets map[Key]*Bucket /* handles onto the buckets held in store */
+
+	store Storage
+	commit sync.Mutex /* serialises Commit */
+	journal *Journal /* nil when running memory only */
+	compact func() error /* snapshots and empties the journal, nil when running memory only */
+}
+
+/* Compact - snapshot the context and empty the journal now rather than at the next interval */
+func (ctx *Context) Compact() error {
+
+	if ctx.compact == nil {
+		return nil
+	}
+	return ctx.compact()
 }
 
 /* AllowApiKey - allow an api key across all buckets, a global api key */
@@ -16,9 +42,12 @@ func (ctx *Context) AllowApiKey(key ApiKey) (bool,error) {
 		return false,KeyInvalid
 	}
 
-	for _,b := range ctx.Buckets {
+	for _,b := range ctx.BucketList() {
 
-		b.AllowApiKey(key) /* we don't care about the return */
+		/* we don't care about the return, only storage failures */
+		if _,err := b.AllowApiKey(key); ignoreAcl(err) != nil {
+			return false,err
+		}
 	}
 	return true,nil
 }
@@ -30,14 +59,27 @@ func (ctx *Context) RevokeApiKey(key ApiKey) (bool,error) {
 		return false,KeyInvalid
 	}
 
-	for _,b := range ctx.Buckets {
+	for _,b := range ctx.BucketList() {
 
-		b.RevokeApiKey(key)
+		if _,err := b.RevokeApiKey(key); ignoreAcl(err) != nil {
+			return false,err
+		}
 	}
 	return true,nil
 }
 
+/* BucketList - all buckets in the global space at the time of the call */
+func (ctx *Context) BucketList() []*Bucket {
 
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	list := make([]*Bucket,0,len(ctx.buckets))
+	for _,b := range ctx.buckets {
+		list = append(list,b)
+	}
+	return list
+}
 
 /* GetBucket - find a global bucket by key */
 func (ctx *Context) GetBucket(key Key) *Bucket {
@@ -46,7 +88,10 @@ func (ctx *Context) GetBucket(key Key) *Bucket {
 		return nil
 	}
 
-	if b,exists := ctx.Buckets[key]; exists {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	if b,exists := ctx.buckets[key]; exists {
 		
 		return b
 	}
@@ -60,15 +105,14 @@ func (ctx *Context) AddBucket(name Key) (*Bucket,error) {
 		return nil,KeyInvalid
 	}
 
-	if b,exists := ctx.Buckets[name]; exists {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if b,exists := ctx.buckets[name]; exists {
 
 		return b,AlreadyPresent
 	}
-
-	b := NewBucket(name)
-	
-	ctx.Buckets[name] = b
-	return b,nil
+	return ctx.addBucket(name)
 }
 
 /* SetBucket - add a new bucket to the global space, if not existing add new, else return previous */
@@ -78,17 +122,27 @@ func (ctx *Context) SetBucket(name Key) (*Bucket,error) {
 		return nil,KeyInvalid
 	}
 
-	if b,exists := ctx.Buckets[name]; exists {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if b,exists := ctx.buckets[name]; exists {
 
 		return b,nil
 	}
+	return ctx.addBucket(name)
+}
 
+/* addBucket - create the bucket in storage, caller holds the lock */
+func (ctx *Context) addBucket(name Key) (*Bucket,error) {
 
-	b := new(Bucket)
-	b.Name = name
-	b.Records = make(map[Key]Record,0)
+	store,err := ctx.store.Create(name)
+	if err != nil {
+		return nil,err
+	}
 
-	ctx.Buckets[name] = b
+	b := newBucket(name,store,ctx.Hasher)
+	
+	ctx.buckets[name] = b
 	return b,nil
 }
 
@@ -99,19 +153,156 @@ func (ctx *Context) DelBucket(name Key) (error) {
 		return KeyInvalid
 	}
 
-	if _,exists := ctx.Buckets[name]; !exists {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if _,exists := ctx.buckets[name]; !exists {
 
 		return NotFound
 	}
 
-	delete(ctx.Buckets,name)
+	if err := ctx.store.Delete(name); err != nil {
+		return err
+	}
+
+	delete(ctx.buckets,name)
 	return nil
 }
 
+/* Sweep - evict expired records from every bucket, committed as deletions so they are journalled
+ * and audited like any other */
+func (ctx *Context) Sweep() int {
+
+	return ctx.sweep(sweepContext())
+}
+
+func (ctx *Context) sweep(c context.Context) int {
+
+	now := time.Now()
+	n := 0
+	for _,b := range ctx.BucketList() {
+
+		swept,err := ctx.sweepBucket(b,now)
+		if err != nil {
+			LogFrom(c).Error("sweep failed","bucket",b.Name,"error",err)
+		}
+		n += swept
+	}
+	return n
+}
+
+func (ctx *Context) sweepBucket(b *Bucket,t time.Time) (int,error) {
+
+	expired,err := b.Expired(t)
+	if err != nil || len(expired) == 0 {
+		return 0,err
+	}
+
+	n := 0
+	err = ctx.CommitFunc(func() ([]Mutation,error) {
+
+		hashed,err := b.store.Hashed()
+		if err != nil {
+			return nil,err
+		}
+		ms := make([]Mutation,0,len(expired))
+		for _,k := range expired {
+
+			/* the record may have been set again since it was seen */
+			r,exists,err := b.store.Get(k)
+			if err != nil {
+				return nil,err
+			}
+			if !exists || !r.Expired(t) {
+				continue
+			}
+			m := NewMutation(OpDelKey,b.Name)
+			m.Key = k
+			m.Hashed = hashed
+			m.By = SystemActor
+			ms = append(ms,m)
+		}
+		n = len(ms)
+		return ms,nil
+	})
+	if err != nil {
+		return 0,err
+	}
+	return n,nil
+}
+
+/* SweepApiKeys - revoke rotated Api Keys past their grace period */
+func (ctx *Context) SweepApiKeys() int {
+
+	return ctx.sweepApiKeys(sweepContext())
+}
+
+func (ctx *Context) sweepApiKeys(c context.Context) int {
+
+	n,err := ctx.RevokeRotated(time.Now())
+	if err != nil {
+		LogFrom(c).Error("sweep failed","bucket","api keys","error",err)
+	}
+	return n
+}
+
+/* sweepContext - each sweep gets an id of its own, carried by its log lines as a request's are */
+func sweepContext() context.Context {
+
+	return WithLog(context.Background(),Log.With("request_id",newRequestID()))
+}
+
+/* Sweeper - sweep every interval, never returns */
+func (ctx *Context) Sweeper(interval time.Duration) {
+
+	for _ = range time.Tick(interval) {
+
+		c := sweepContext()
+		if n := ctx.sweep(c); n > 0 {
+			LogFrom(c).Info("swept expired records","records",n)
+		}
+		if n := ctx.sweepApiKeys(c); n > 0 {
+			LogFrom(c).Info("revoked rotated api keys","api_keys",n)
+		}
+	}
+}
+
+/* Close - release the underlying storage */
+func (ctx *Context) Close() error {
+
+	return ctx.store.Close()
+}
+
+/* NewContext - a context held entirely in memory */
 func NewContext() *Context {
 
-	c := new(Context)
-	c.Buckets = make(map[Key]*Bucket,0)
+	c,_ := NewContextWithStorage(NewMemoryStorage()) /* memory storage never fails */
 	return c
 }
 
+/* NewContextWithStorage - a context over the given storage, picking up any buckets it already holds */
+func NewContextWithStorage(store Storage) (*Context,error) {
+
+	names,err := store.Names()
+	if err != nil {
+		return nil,err
+	}
+
+	c := new(Context)
+	c.Admins = NewAdminSet()
+	c.Certs = NewCertIdentities()
+	c.Health = NewHealth()
+	c.Metrics = NewMetrics()
+	c.Hasher = NewHasher()
+	c.store = store
+	c.buckets = make(map[Key]*Bucket,len(names))
+	for _,name := range names {
+
+		bs,err := store.Open(name)
+		if err != nil {
+			return nil,err
+		}
+		c.buckets[name] = newBucket(name,bs,c.Hasher)
+	}
+	return c,nil
+}
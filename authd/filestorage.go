@@ -0,0 +1,452 @@
+/* authd/authd/filestorage.go */
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	FileStorageName = "authd.db"
+)
+
+var (
+	registryBucket = []byte("/apikeys") /* a '/' can never reach a bucket name through the api */
+	recordsBucket = []byte("records")
+	liveKey = []byte("live")
+	hashedKey = []byte("hashed")
+	aclKey = []byte("acl")
+	countKey = []byte("count") /* records held, kept so Len need not walk the bucket */
+)
+
+/* FileStorage - buckets kept in an embedded on-disk database, records are only read
+ * into memory as they are checked. Every write is committed and synced before returning */
+type FileStorage struct {
+
+	db *bolt.DB
+
+	failedMu sync.Mutex
+	failed error /* of the last write, nil once a write succeeds again */
+}
+
+type fileBucket struct {
+
+	s *FileStorage
+	name []byte
+}
+
+func (s *FileStorage) Names() ([]Key,error) {
+
+	names := make([]Key,0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte,_ *bolt.Bucket) error {
+			if string(name) != string(registryBucket) {
+				names = append(names,Key(name))
+			}
+			return nil
+		})
+	})
+	return names,err
+}
+
+func (s *FileStorage) Open(name Key) (BucketStorage,error) {
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(name)) == nil {
+			return NotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil,err
+	}
+	return &fileBucket{s,[]byte(name)},nil
+}
+
+func (s *FileStorage) Create(name Key) (BucketStorage,error) {
+
+	if string(name) == string(registryBucket) {
+		return nil,KeyInvalid
+	}
+
+	err := s.update(func(tx *bolt.Tx) error {
+
+		b,err := tx.CreateBucket([]byte(name))
+		if err == bolt.ErrBucketExists {
+			return AlreadyPresent
+		}
+		if err != nil {
+			return err
+		}
+		if _,err := b.CreateBucket(recordsBucket); err != nil {
+			return err
+		}
+		if err := putCount(b,0); err != nil {
+			return err
+		}
+		return b.Put(liveKey,[]byte("no"))
+	})
+	if err != nil {
+		return nil,err
+	}
+	return &fileBucket{s,[]byte(name)},nil
+}
+
+func (s *FileStorage) Delete(name Key) error {
+
+	return s.update(func(tx *bolt.Tx) error {
+
+		err := tx.DeleteBucket([]byte(name))
+		if err == bolt.ErrBucketNotFound {
+			return NotFound
+		}
+		return err
+	})
+}
+
+func (s *FileStorage) Close() error {
+
+	return s.db.Close()
+}
+
+/* update - a write transaction, remembering whether the database itself failed, a read only or
+ * full disk, as apart from fn refusing the write */
+func (s *FileStorage) update(fn func(*bolt.Tx) error) error {
+
+	var ferr error
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ferr = fn(tx)
+		return ferr
+	})
+	if err == nil || err != ferr {
+		s.setFailed(err)
+	}
+	return err
+}
+
+func (s *FileStorage) setFailed(err error) {
+
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	s.failed = err
+}
+
+/* Ping - fails when the last write failed, or the database is closed or its file has gone, a read
+ * transaction never waits on a write so it is cheap enough for every probe */
+func (s *FileStorage) Ping() error {
+
+	s.failedMu.Lock()
+	err := s.failed
+	s.failedMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_,err = os.Stat(s.db.Path())
+	return err
+}
+
+func (s *FileStorage) ApiKey(key ApiKey) (ApiKeyRecord,bool,error) {
+
+	var rec ApiKeyRecord
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+
+		data := tx.Bucket(registryBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data,&rec)
+	})
+	return rec,found,err
+}
+
+func (s *FileStorage) PutApiKey(rec ApiKeyRecord) error {
+
+	data,err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(registryBucket).Put([]byte(rec.Key),data)
+	})
+}
+
+func (s *FileStorage) EachApiKey(fn func(ApiKeyRecord) error) error {
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(registryBucket).ForEach(func(_,v []byte) error {
+
+			var rec ApiKeyRecord
+			if err := json.Unmarshal(v,&rec); err != nil {
+				return err
+			}
+			return fn(rec)
+		})
+	})
+}
+
+/* view/update - run fn against this bucket, which may have been deleted underneath the handle */
+func (fb *fileBucket) view(fn func(*bolt.Bucket) error) error {
+
+	return fb.s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(fb.name)
+		if b == nil {
+			return NotFound
+		}
+		return fn(b)
+	})
+}
+
+func (fb *fileBucket) update(fn func(*bolt.Bucket) error) error {
+
+	return fb.s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(fb.name)
+		if b == nil {
+			return NotFound
+		}
+		return fn(b)
+	})
+}
+
+func (fb *fileBucket) Get(key Key) (Record,bool,error) {
+
+	var r Record
+	found := false
+	err := fb.view(func(b *bolt.Bucket) error {
+
+		data := b.Bucket(recordsBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data,&r)
+	})
+	return r,found,err
+}
+
+func (fb *fileBucket) Put(key Key,r Record) error {
+
+	data,err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return fb.update(func(b *bolt.Bucket) error {
+
+		records := b.Bucket(recordsBucket)
+		if records.Get([]byte(key)) == nil {
+			if err := putCount(b,getCount(b) + 1); err != nil {
+				return err
+			}
+		}
+		return records.Put([]byte(key),data)
+	})
+}
+
+func (fb *fileBucket) Del(key Key) (bool,error) {
+
+	found := false
+	err := fb.update(func(b *bolt.Bucket) error {
+
+		records := b.Bucket(recordsBucket)
+		if records.Get([]byte(key)) == nil {
+			return nil
+		}
+		found = true
+		if err := putCount(b,getCount(b) - 1); err != nil {
+			return err
+		}
+		return records.Delete([]byte(key))
+	})
+	return found,err
+}
+
+func (fb *fileBucket) Len() (int,error) {
+
+	n := 0
+	err := fb.view(func(b *bolt.Bucket) error {
+		n = getCount(b)
+		return nil
+	})
+	return n,err
+}
+
+func (fb *fileBucket) Empty() (bool,error) {
+
+	empty := true
+	err := fb.view(func(b *bolt.Bucket) error {
+		k,_ := b.Bucket(recordsBucket).Cursor().First()
+		empty = k == nil
+		return nil
+	})
+	return empty,err
+}
+
+func getCount(b *bolt.Bucket) int {
+
+	n,_ := strconv.Atoi(string(b.Get(countKey)))
+	return n
+}
+
+func putCount(b *bolt.Bucket,n int) error {
+
+	return b.Put(countKey,[]byte(strconv.Itoa(n)))
+}
+
+func (fb *fileBucket) Each(fn func(Key,Record) error) error {
+
+	return fb.view(func(b *bolt.Bucket) error {
+		return b.Bucket(recordsBucket).ForEach(func(k,v []byte) error {
+
+			var r Record
+			if err := json.Unmarshal(v,&r); err != nil {
+				return err
+			}
+			return fn(Key(k),r)
+		})
+	})
+}
+
+func (fb *fileBucket) Live() (bool,error) {
+
+	live := false
+	err := fb.view(func(b *bolt.Bucket) error {
+		live = string(b.Get(liveKey)) == "yes"
+		return nil
+	})
+	return live,err
+}
+
+func (fb *fileBucket) SetLive(live bool) error {
+
+	value := []byte("no")
+	if live {
+		value = []byte("yes")
+	}
+	return fb.update(func(b *bolt.Bucket) error {
+		return b.Put(liveKey,value)
+	})
+}
+
+func (fb *fileBucket) Hashed() (bool,error) {
+
+	hashed := false
+	err := fb.view(func(b *bolt.Bucket) error {
+		hashed = string(b.Get(hashedKey)) == "yes"
+		return nil
+	})
+	return hashed,err
+}
+
+func (fb *fileBucket) SetHashed(hashed bool) error {
+
+	value := []byte("no")
+	if hashed {
+		value = []byte("yes")
+	}
+	return fb.update(func(b *bolt.Bucket) error {
+		return b.Put(hashedKey,value)
+	})
+}
+
+/* HashKeys - in a single transaction, so a crash leaves the bucket either as it was or fully hashed */
+func (fb *fileBucket) HashKeys(sum func(Key) (Key,error)) error {
+
+	return fb.update(func(b *bolt.Bucket) error {
+
+		records := b.Bucket(recordsBucket)
+		moved := make(map[string]Key)
+		values := make(map[string][]byte)
+		err := records.ForEach(func(k,v []byte) error {
+			d,err := sum(Key(k))
+			if err != nil || string(d) == string(k) {
+				return err
+			}
+			moved[string(k)] = d
+			values[string(k)] = append([]byte(nil),v...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		n := getCount(b)
+		for k := range moved {
+			if err := records.Delete([]byte(k)); err != nil {
+				return err
+			}
+			n--
+		}
+		for k,d := range moved {
+			if records.Get([]byte(d)) != nil {
+				continue
+			}
+			if err := records.Put([]byte(d),values[k]); err != nil {
+				return err
+			}
+			n++
+		}
+		if err := putCount(b,n); err != nil {
+			return err
+		}
+		return b.Put(hashedKey,[]byte("yes"))
+	})
+}
+
+func (fb *fileBucket) ApiKeys() ([]ApiKey,error) {
+
+	keys := make([]ApiKey,0)
+	err := fb.view(func(b *bolt.Bucket) error {
+
+		data := b.Get(aclKey)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data,&keys)
+	})
+	return keys,err
+}
+
+func (fb *fileBucket) SetApiKeys(keys []ApiKey) error {
+
+	data,err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return fb.update(func(b *bolt.Bucket) error {
+		return b.Put(aclKey,data)
+	})
+}
+
+func OpenFileStorage(path string) (*FileStorage,error) {
+
+	db,err := bolt.Open(path,0600,&bolt.Options{Timeout:1 * time.Second})
+	if err != nil {
+		return nil,err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_,err := tx.CreateBucketIfNotExists(registryBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil,err
+	}
+
+	s := new(FileStorage)
+	s.db = db
+	return s,nil
+}
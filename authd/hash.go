@@ -0,0 +1,100 @@
+/* authd/authd/hash.go */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const (
+	MinHashSecret = 16 /* bytes */
+)
+
+var (
+	HashSecretMissing = errors.New("Hash Secret Missing")
+	HashSecretInvalid = errors.New("Invalid Hash Secret")
+)
+
+/* Hasher - keyed hashing of record keys for hashed buckets, the secret never leaves the process
+ * so a leaked snapshot or memory dump of the records gives only digests */
+type Hasher struct {
+
+	mu sync.RWMutex
+	secret []byte
+}
+
+func (h *Hasher) SetSecret(secret []byte) error {
+
+	if len(secret) < MinHashSecret {
+		return HashSecretInvalid
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.secret = append([]byte(nil),secret...)
+	return nil
+}
+
+/* Ready - has a secret been set, hashed buckets cannot be used without one */
+func (h *Hasher) Ready() bool {
+
+	if h == nil {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.secret) > 0
+}
+
+/* Sum - the digest key is stored under in bucket, bound to the bucket so the same key has a
+ * different digest in every bucket */
+func (h *Hasher) Sum(bucket,key Key) (Key,error) {
+
+	if !h.Ready() {
+		return "",HashSecretMissing
+	}
+
+	h.mu.RLock()
+	mac := hmac.New(sha256.New,h.secret)
+	h.mu.RUnlock()
+
+	mac.Write([]byte(bucket))
+	mac.Write([]byte{0})
+	mac.Write([]byte(key))
+	return Key(hex.EncodeToString(mac.Sum(nil))),nil
+}
+
+/* isDigest - does key have the form of a digest from Sum */
+func isDigest(key Key) bool {
+
+	if len(key) != 2 * sha256.Size {
+		return false
+	}
+	for _,c := range key {
+		if !strings.ContainsRune("0123456789abcdef",c) {
+			return false
+		}
+	}
+	return true
+}
+
+func NewHasher() *Hasher {
+
+	return new(Hasher)
+}
+
+/* LoadHashSecret - read the secret from a file, surrounding whitespace is ignored */
+func LoadHashSecret(path string) ([]byte,error) {
+
+	data,err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil,err
+	}
+	return []byte(strings.TrimSpace(string(data))),nil
+}
@@ -0,0 +1,305 @@
+/* authd/authd/hash_test.go */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	testHashSecret = []byte("0123456789abcdef0123456789abcdef")
+)
+
+func Test_HashedBucket(t *testing.T) {
+
+	ctx := NewContext()
+	b,_ := ctx.AddBucket("users")
+	b.Add("alice@example.com")
+	b.SetRecord("bob@example.com",Record{Uses:2})
+
+	if err := b.Hash(); err != HashSecretMissing {
+		t.Fatalf("expected hash secret missing, got %v",err)
+	}
+	if err := ctx.Hasher.SetSecret([]byte("short")); err != HashSecretInvalid {
+		t.Fatalf("expected a short secret to be refused, got %v",err)
+	}
+	ctx.Admins.Add("admin",RoleAdmin,DefaultAdminKey)
+	srv := testServer(ctx)
+	defer srv.Close()
+	if status,_ := do("PUT",srv.URL + "/api/v1/g/users?hash=yes","X-AdminKey",DefaultAdminKey); status != 400 {
+		t.Fatalf("expected hashing without a secret to be refused, got %d",status)
+	}
+	ctx.Hasher.SetSecret(testHashSecret)
+
+	/* existing records are converted */
+	if err := b.Hash(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n,_ := b.Len(); !b.IsHashed() || n != 2 {
+		t.Fatalf("expected a hashed bucket of 2 records, got %v %d",b.IsHashed(),n)
+	}
+	if r,exists,_ := b.GetRecord("bob@example.com"); !exists || r.Uses != 2 {
+		t.Fatalf("expected bob to keep his record, got %v %+v",exists,r)
+	}
+
+	if !b.Add("carol@example.com") || !b.Check("carol@example.com") || !b.Check("alice@example.com") {
+		t.Fatalf("expected checks on a hashed bucket to be transparent")
+	}
+	if b.Check("mallory@example.com") {
+		t.Fatalf("expected mallory not to be found")
+	}
+	if !b.Del("alice@example.com") || b.Check("alice@example.com") {
+		t.Fatalf("expected alice to be deleted")
+	}
+
+	b.Each(func(k Key,r Record) error {
+		if strings.Contains(string(k),"@") {
+			t.Fatalf("expected only digests, found %s",k)
+		}
+		return nil
+	})
+
+	/* the same key has a different digest in every bucket */
+	other,_ := ctx.AddBucket("admins")
+	other.Hash()
+	d1,_ := b.StoredKey("carol@example.com")
+	d2,_ := other.StoredKey("carol@example.com")
+	if d1 == d2 {
+		t.Fatalf("expected digests to be bound to the bucket")
+	}
+
+	/* hashing twice changes nothing */
+	if err := b.Hash(); err != nil || !b.Check("carol@example.com") {
+		t.Fatalf("expected hashing again to be a no-op, got %v",err)
+	}
+}
+
+/* neither the journal nor the snapshot of a hashed bucket holds a plaintext key */
+func Test_HashedPersistence(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := NewContext()
+	ctx.Hasher.SetSecret(testHashSecret)
+	ctx.Admins.Add("admin",RoleAdmin,DefaultAdminKey)
+	p,err := NewPersister(dir,ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p.Load()
+
+	srv := testServer(ctx)
+	defer srv.Close()
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/users?enable=yes",200),
+		asAdmin("PUT","/api/v1/g/users/alice@example.com",200),
+		asAdmin("PUT","/api/v1/g/users?hash=yes",200))
+
+	/* alice went into the journal before the bucket was hashed, hashing compacts her away at once */
+	journal,_ := ioutil.ReadFile(filepath.Join(dir,JournalFile))
+	snapshot,_ := ioutil.ReadFile(p.Path())
+	if strings.Contains(string(journal) + string(snapshot),"@example.com") {
+		t.Fatalf("expected no plaintext key once the bucket is hashed")
+	}
+
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/users/bob@example.com?uses=3",200),
+		asAdmin("DELETE","/api/v1/g/users/alice@example.com",200))
+
+	journal,_ = ioutil.ReadFile(filepath.Join(dir,JournalFile))
+	if strings.Contains(string(journal),"bob@example.com") {
+		t.Fatalf("expected no plaintext key in the journal")
+	}
+
+	if err := p.Save(); err != nil {
+		t.Fatal(err.Error())
+	}
+	snapshot,_ = ioutil.ReadFile(p.Path())
+	if strings.Contains(string(snapshot),"@example.com") {
+		t.Fatalf("expected no plaintext key in the snapshot")
+	}
+	p.journal.Close()
+
+	/* the secret is needed to load it again */
+	p,_ = NewPersister(dir,NewContext())
+	if err := p.Load(); err != HashSecretMissing {
+		t.Fatalf("expected hash secret missing, got %v",err)
+	}
+	p.journal.Close()
+
+	restored := NewContext()
+	restored.Hasher.SetSecret(testHashSecret)
+	p,_ = NewPersister(dir,restored)
+	if err := p.Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+	b := restored.GetBucket("users")
+	if b == nil || !b.IsHashed() {
+		t.Fatalf("expected hashed bucket users")
+	}
+	if r,exists,_ := b.GetRecord("bob@example.com"); !exists || r.Uses != 3 {
+		t.Fatalf("expected bob with 3 uses, got %v %+v",exists,r)
+	}
+	if b.Check("alice@example.com") {
+		t.Fatalf("expected alice to be gone")
+	}
+}
+
+func Test_HashedFileStorage(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir,FileStorageName)
+	fs,err := OpenFileStorage(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx,_ := NewContextWithStorage(fs)
+	ctx.Hasher.SetSecret(testHashSecret)
+	b,_ := ctx.AddBucket("users")
+	b.Add("alice@example.com")
+	if err := b.Hash(); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx.Close()
+
+	fs,_ = OpenFileStorage(path)
+	ctx,_ = NewContextWithStorage(fs)
+	defer ctx.Close()
+	ctx.Hasher.SetSecret(testHashSecret)
+
+	b = ctx.GetBucket("users")
+	if n,_ := b.Len(); !b.IsHashed() || !b.Check("alice@example.com") || n != 1 {
+		t.Fatalf("expected hashed bucket users holding alice after reopening")
+	}
+}
+
+/* plaintextKeys - the keys of b that are not digests */
+func plaintextKeys(b *Bucket) []Key {
+
+	keys := make([]Key,0)
+	b.Each(func(k Key,_ Record) error {
+		if !isDigest(k) {
+			keys = append(keys,k)
+		}
+		return nil
+	})
+	return keys
+}
+
+/* a crash after the snapshot of a hashed bucket is written but before the journal is truncated
+ * replays keys journalled before the bucket was hashed, they must be hashed and not written plain */
+func Test_HashReplay(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := NewContext()
+	ctx.Hasher.SetSecret(testHashSecret)
+	p,err := NewPersister(dir,ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p.Load()
+
+	set := func(key Key) Mutation {
+		m := NewMutation(OpSetKey,"users")
+		m.Key = key
+		return m
+	}
+	err = ctx.Commit(NewMutation(OpSetBucket,"users"),set("alice@example.com"),set("carol@example.com"),NewMutation(OpHashBucket,"users"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _,err := ctx.CommitKey(ctx.GetBucket("users"),"carol@example.com",NewMutation(OpDelKey,"users")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := SaveSnapshot(p.Path(),ctx.Snapshot()); err != nil {
+		t.Fatal(err.Error())
+	}
+	p.journal.Close()
+
+	restored := NewContext()
+	restored.Hasher.SetSecret(testHashSecret)
+	p,_ = NewPersister(dir,restored)
+	defer p.journal.Close()
+	if err := p.Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b := restored.GetBucket("users")
+	if keys := plaintextKeys(b); len(keys) != 0 {
+		t.Fatalf("expected no plaintext key after replay, got %v",keys)
+	}
+	if n,_ := b.Len(); n != 1 || !b.Check("alice@example.com") || b.Check("carol@example.com") {
+		t.Fatalf("expected only alice after replay, got %d records",n)
+	}
+
+	/* without a bucket.hash after it to tidy up */
+	if err := restored.Apply(set("dave@example.com")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if keys := plaintextKeys(b); len(keys) != 0 || !b.Check("dave@example.com") {
+		t.Fatalf("expected dave to be hashed when applied, got %v",keys)
+	}
+}
+
+/* hashing a hashed bucket hashes the plaintext keys an interrupted conversion left behind */
+func Test_HashLeftovers(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	fs,err := OpenFileStorage(filepath.Join(dir,FileStorageName))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	files,_ := NewContextWithStorage(fs)
+	for _,ctx := range []*Context{NewContext(),files} {
+
+		ctx.Hasher.SetSecret(testHashSecret)
+		b,_ := ctx.AddBucket("users")
+		alice,_ := ctx.Hasher.Sum("users","alice@example.com")
+
+		/* alice was hashed and used once since, bob was never hashed */
+		b.store.Put("alice@example.com",Record{Uses:3})
+		b.store.Put(alice,Record{Uses:2})
+		b.store.Put("bob@example.com",Record{Uses:3})
+		b.store.SetHashed(true)
+
+		if err := b.Hash(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if keys := plaintextKeys(b); len(keys) != 0 {
+			t.Fatalf("expected no plaintext key, got %v",keys)
+		}
+		if n,_ := b.Len(); n != 2 {
+			t.Fatalf("expected 2 records, got %d",n)
+		}
+		if r,_,_ := b.GetRecord("alice@example.com"); r.Uses != 2 {
+			t.Fatalf("expected the hashed record of alice to be kept, got %+v",r)
+		}
+		if r,_,_ := b.GetRecord("bob@example.com"); r.Uses != 3 {
+			t.Fatalf("expected bob to be hashed, got %+v",r)
+		}
+		ctx.Close()
+	}
+}
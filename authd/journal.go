@@ -0,0 +1,388 @@
+/* authd/authd/journal.go */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	JournalFile = "journal.log"
+
+	OpSetBucket = "bucket.set"
+	OpDelBucket = "bucket.del"
+	OpEnableBucket = "bucket.enable"
+	OpDisableBucket = "bucket.disable"
+	OpHashBucket = "bucket.hash"
+	OpAllowApiKey = "bucket.allow"
+	OpRevokeApiKey = "bucket.revoke"
+	OpSetKey = "key.set"
+	OpDelKey = "key.del"
+	OpIssueApiKey = "apikey.issue"
+	OpUpdateApiKey = "apikey.update"
+	OpRevokeApiKeyGlobal = "apikey.revoke"
+)
+
+/* Mutation - a single admin change to the context, the unit written to the journal */
+type Mutation struct {
+
+	Op string `json:"op"`
+	Time time.Time `json:"time"`
+	Bucket Key `json:"bucket,omitempty"`
+	Key Key `json:"key,omitempty"` /* as stored, the digest in a hashed bucket */
+	Hashed bool `json:"hashed,omitempty"` /* the bucket was hashed when committed, Key is a digest */
+	ApiKey ApiKey `json:"api_key,omitempty"`
+	Record *Record `json:"record,omitempty"` /* key.set, created at Time if absent */
+	Issued *ApiKeyRecord `json:"issued,omitempty"` /* apikey.issue and apikey.update */
+
+	By Actor `json:"-"` /* for the audit log, not journalled */
+}
+
+func NewMutation(op string,bucket Key) Mutation {
+
+	return Mutation{Op:op,Time:time.Now(),Bucket:bucket}
+}
+
+/* Apply - perform a mutation against the context, used both live and on journal replay so
+ * every operation must be idempotent */
+func (ctx *Context) Apply(m Mutation) error {
+
+	switch m.Op {
+	case OpSetBucket:
+		_,err := ctx.SetBucket(m.Bucket)
+		return err
+	case OpDelBucket:
+		return ctx.DelBucket(m.Bucket)
+	case OpIssueApiKey,OpUpdateApiKey:
+		if m.Issued == nil {
+			return KeyInvalid
+		}
+		return ctx.store.PutApiKey(*m.Issued)
+	case OpRevokeApiKeyGlobal:
+		if err := ctx.markRevoked(m.ApiKey); err != nil {
+			return err
+		}
+		_,err := ctx.RevokeApiKey(m.ApiKey)
+		return err
+	}
+
+	b := ctx.GetBucket(m.Bucket)
+	if b == nil {
+		return NotFound
+	}
+
+	switch m.Op {
+	case OpEnableBucket:
+		return b.SetLive(true)
+	case OpDisableBucket:
+		return b.SetLive(false)
+	case OpAllowApiKey:
+		_,err := b.AllowApiKey(m.ApiKey)
+		return ignoreAcl(err)
+	case OpRevokeApiKey:
+		_,err := b.RevokeApiKey(m.ApiKey)
+		return ignoreAcl(err)
+	case OpSetKey:
+		if !m.Key.IsValid() {
+			return KeyInvalid
+		}
+		stored,err := replayKey(b,m)
+		if err != nil {
+			return err
+		}
+		r := Record{Created:m.Time}
+		if m.Record != nil {
+			r = *m.Record
+		}
+		return b.setStored(stored,r)
+	case OpDelKey:
+		stored,err := replayKey(b,m)
+		if err != nil {
+			return err
+		}
+		_,err = b.delStored(stored)
+		return err
+	case OpHashBucket:
+		return b.Hash()
+	}
+	return UnknownOperation
+}
+
+/* replayKey - the key a key.set or key.del applies to, a plaintext key journalled before its bucket
+ * was hashed is hashed when replayed over a snapshot taken after */
+func replayKey(b *Bucket,m Mutation) (Key,error) {
+
+	if m.Hashed {
+		return m.Key,nil
+	}
+	hashed,err := b.store.Hashed()
+	if err != nil || !hashed {
+		return m.Key,err
+	}
+	return b.hasher.Sum(b.Name,m.Key)
+}
+
+/* ignoreAcl - allowing a present key or revoking an absent one is not a failure, storage errors are */
+func ignoreAcl(err error) error {
+
+	switch err {
+	case ApiKeyAlreadyPresent,ApiKeyNotFound,KeyInvalid:
+		return nil
+	}
+	return err
+}
+
+/* Commit - journal the mutations (if journaling) and then apply them, nothing is applied
+ * unless the journal write has reached disk */
+func (ctx *Context) Commit(ms ...Mutation) error {
+
+	return ctx.CommitFunc(func() ([]Mutation,error) {
+		return ms,nil
+	})
+}
+
+/* CommitFunc - as Commit, with the mutations decided by reading the current state, commits are
+ * serialised so nothing else is committed between decide and apply. Nothing is committed while
+ * the audit log is failing */
+func (ctx *Context) CommitFunc(decide func() ([]Mutation,error)) error {
+
+	ctx.commit.Lock()
+	defer ctx.commit.Unlock()
+
+	if ctx.Audit != nil && ctx.Audit.Ping() != nil {
+		return AuditFailing
+	}
+
+	ms,err := decide()
+	if err != nil || len(ms) == 0 {
+		return err
+	}
+
+	/* the audit log gets what was applied, with the state either side of each mutation */
+	audited := make([]AuditEntry,0)
+	apply := func() error {
+		for _,m := range ms {
+
+			var old interface{}
+			if ctx.Audit != nil {
+				old = ctx.auditState(m)
+			}
+			if err := ctx.Apply(m); err != nil {
+				return err
+			}
+			if m.By.ApiKey == "" {
+				ctx.Metrics.AdminOp(m.Op) /* uses consumed by clients are checks, not admin changes */
+			}
+			if ctx.Audit != nil {
+				audited = append(audited,ctx.auditEntry(m,old))
+			}
+		}
+		return nil
+	}
+
+	if ctx.journal == nil {
+		err = apply()
+	} else {
+		err = ctx.journal.Commit(ms,apply)
+	}
+
+	/* the change has been made, an audit failure is logged and refuses the commits after it */
+	for _,e := range audited {
+		if aerr := ctx.Audit.Append(e); aerr != nil {
+			Log.Error("audit failed","path",ctx.Audit.path,"op",e.Op,"error",aerr)
+		}
+	}
+	return err
+}
+
+/* CommitKey - commit a key.set or key.del of key in b, the key is replaced by the key it is stored
+ * under so a hashed bucket never has the plaintext key journalled. Returns the stored key */
+func (ctx *Context) CommitKey(b *Bucket,key Key,m Mutation) (Key,error) {
+
+	if !key.IsValid() {
+		return key,KeyInvalid
+	}
+
+	err := ctx.CommitFunc(func() ([]Mutation,error) {
+
+		stored,hashed,err := b.storedKey(key)
+		if err != nil {
+			return nil,err
+		}
+		m.Key = stored
+		m.Hashed = hashed
+		return []Mutation{m},nil
+	})
+	return m.Key,err
+}
+
+/* UseKey - check for a key, consuming one use of a limited-use record. The remaining count is
+ * committed as an absolute value so replay stays idempotent, the last use deletes the record.
+ * by is the client checking. Also says whether the record had limited uses, an answer that must
+ * not be cached */
+func (ctx *Context) UseKey(b *Bucket,key Key,by Actor) (bool,bool,error) {
+
+	r,exists,err := b.GetRecord(key)
+	if err != nil || !exists {
+		return false,false,err
+	}
+	if r.Uses == 0 {
+		return true,false,nil /* unlimited, nothing to commit */
+	}
+
+	found := false
+	err = ctx.CommitFunc(func() ([]Mutation,error) {
+
+		r,exists,err := b.GetRecord(key)
+		if err != nil {
+			return nil,err
+		}
+		if !exists {
+			return nil,nil /* consumed or deleted since */
+		}
+		found = true
+		if r.Uses == 0 {
+			return nil,nil
+		}
+
+		stored,hashed,err := b.storedKey(key)
+		if err != nil {
+			return nil,err
+		}
+
+		m := NewMutation(OpDelKey,b.Name)
+		m.Key = stored
+		m.Hashed = hashed
+		m.By = by
+		if r.Uses > 1 {
+			r.Uses--
+			m.Op = OpSetKey
+			m.Record = &r
+		}
+		return []Mutation{m},nil
+	})
+	if err != nil {
+		return false,true,err
+	}
+	return found,true,nil
+}
+
+/* Journal - append-only, fsync'd log of mutations since the last snapshot */
+type Journal struct {
+
+	mu sync.Mutex
+	path string
+	f *os.File
+
+	failedMu sync.Mutex /* apart from mu so Ping never waits on a commit or compaction */
+	failed error /* of the last write, nil once a write succeeds again */
+}
+
+func OpenJournal(path string) (*Journal,error) {
+
+	f,err := os.OpenFile(path,os.O_RDWR|os.O_CREATE|os.O_APPEND,0600)
+	if err != nil {
+		return nil,err
+	}
+
+	j := new(Journal)
+	j.path = path
+	j.f = f
+	return j,nil
+}
+
+/* Commit - append the mutations and sync before calling apply, holding off any compaction */
+func (j *Journal) Commit(ms []Mutation,apply func() error) error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.setFailed(j.append(ms)); err != nil {
+		return err
+	}
+	return apply()
+}
+
+func (j *Journal) append(ms []Mutation) error {
+
+	w := bufio.NewWriter(j.f)
+	enc := json.NewEncoder(w)
+	for _,m := range ms {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+/* Replay - feed every journalled mutation to fn in order, a torn final entry (crash mid-write)
+ * is dropped, fn errors are logged and skipped as they failed the same way when first applied */
+func (j *Journal) Replay(fn func(Mutation) error) (int,error) {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f,err := os.Open(j.path)
+	if err != nil {
+		return 0,err
+	}
+	defer f.Close()
+
+	n := 0
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+
+		var m Mutation
+		if err := dec.Decode(&m); err != nil {
+			Log.Warn("journal truncated","path",j.path,"entries",n,"error",err)
+			break
+		}
+		if err := fn(m); err != nil {
+			Log.Warn("journal replay failed","op",m.Op,"bucket",m.Bucket,"key",Redact.Key(m.Key),"error",err)
+		}
+		n++
+	}
+	return n,nil
+}
+
+/* Compact - run fn (which must persist everything journalled so far) and on success empty the journal */
+func (j *Journal) Compact(fn func() error) error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := j.setFailed(j.f.Truncate(0)); err != nil {
+		return err
+	}
+	return j.setFailed(j.f.Sync())
+}
+
+func (j *Journal) setFailed(err error) error {
+
+	j.failedMu.Lock()
+	defer j.failedMu.Unlock()
+	j.failed = err
+	return err
+}
+
+/* Ping - the error of the last write, fails once the journal can no longer be written */
+func (j *Journal) Ping() error {
+
+	j.failedMu.Lock()
+	defer j.failedMu.Unlock()
+	return j.failed
+}
+
+func (j *Journal) Close() error {
+
+	return j.f.Close()
+}
@@ -0,0 +1,223 @@
+/* authd/authd/journal_test.go */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_JournalReplay(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := NewContext()
+	p,err := NewPersister(dir,ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := p.Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	set := NewMutation(OpSetKey,"foo")
+	set.Key = "bar"
+	tin := NewMutation(OpSetKey,"foo")
+	tin.Key = "tin"
+
+	err = ctx.Commit(NewMutation(OpSetBucket,"foo"),NewMutation(OpEnableBucket,"foo"),set,tin)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tin.Op = OpDelKey
+	if err := ctx.Commit(tin); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	/* no snapshot taken since, so a restart must rebuild from the journal alone */
+	p.journal.Close()
+
+	restored := NewContext()
+	p,_ = NewPersister(dir,restored)
+	if err := p.Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b := restored.GetBucket("foo")
+	if b == nil {
+		t.Fatalf("expected bucket foo")
+	}
+	if live,_ := b.IsLive(); !live {
+		t.Fatalf("expected bucket foo to be live")
+	}
+	if !b.Check("bar") {
+		t.Fatalf("expected key bar in bucket foo")
+	}
+	if b.Check("tin") {
+		t.Fatalf("expected key tin to have been deleted")
+	}
+
+	/* loading compacts */
+	fi,err := os.Stat(filepath.Join(dir,JournalFile))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("expected journal to be compacted, %d bytes remain",fi.Size())
+	}
+}
+
+func Test_JournalTornEntry(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := NewContext()
+	p,_ := NewPersister(dir,ctx)
+	if err := ctx.Commit(NewMutation(OpSetBucket,"foo")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	/* simulate a crash part way through writing the next entry */
+	p.journal.f.WriteString(`{"op":"bucket.set","bucket":"so`)
+	p.journal.Close()
+
+	restored := NewContext()
+	p,_ = NewPersister(dir,restored)
+	if err := p.Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if restored.GetBucket("foo") == nil {
+		t.Fatalf("expected bucket foo")
+	}
+	if restored.GetBucket("so") != nil {
+		t.Fatalf("expected torn entry to be dropped")
+	}
+}
+
+func Test_JournalUseKey(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := NewContext()
+	p,_ := NewPersister(dir,ctx)
+
+	set := NewMutation(OpSetKey,"foo")
+	set.Key = "bar"
+	set.Record = &Record{Created:set.Time,Uses:2}
+	if err := ctx.Commit(NewMutation(OpSetBucket,"foo"),set); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if ok,limited,err := ctx.UseKey(ctx.GetBucket("foo"),"bar",SystemActor); !ok || !limited || err != nil {
+		t.Fatalf("expected first use to succeed (%v)",err)
+	}
+	p.journal.Close()
+
+	/* the consumed use must survive a restart */
+	restored := NewContext()
+	p,_ = NewPersister(dir,restored)
+	if err := p.Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b := restored.GetBucket("foo")
+	if ok,_,_ := restored.UseKey(b,"bar",SystemActor); !ok {
+		t.Fatalf("expected last use to succeed")
+	}
+	if ok,_,_ := restored.UseKey(b,"bar",SystemActor); ok {
+		t.Fatalf("expected record to be used up")
+	}
+	if n,_ := b.Len(); n != 0 {
+		t.Fatalf("expected used up record to be removed")
+	}
+}
+
+/* swept records are deleted through the journal, not behind it */
+func Test_JournalSweep(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := NewContext()
+	p,_ := NewPersister(dir,ctx)
+
+	set := NewMutation(OpSetKey,"foo")
+	set.Key = "bar"
+	set.Record = &Record{Created:set.Time,Expires:set.Time.Add(-time.Second)}
+	if err := ctx.Commit(NewMutation(OpSetBucket,"foo"),set); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := ctx.Sweep(); n != 1 {
+		t.Fatalf("expected 1 record swept, got %d",n)
+	}
+	p.journal.Close()
+
+	data,_ := ioutil.ReadFile(filepath.Join(dir,JournalFile))
+	if !strings.Contains(string(data),`"op":"key.del"`) {
+		t.Fatalf("expected the sweep to be journalled\n%s",data)
+	}
+
+	restored := NewContext()
+	p,_ = NewPersister(dir,restored)
+	if err := p.Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n,_ := restored.GetBucket("foo").Len(); n != 0 {
+		t.Fatalf("expected the swept record to stay gone, %d remain",n)
+	}
+}
+
+/* readiness reports the last write and never waits on the journal */
+func Test_JournalPing(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := NewContext()
+	p,_ := NewPersister(dir,ctx)
+	if err := p.journal.Ping(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p.journal.mu.Lock()
+	done := make(chan error,1)
+	go func() { done <- p.journal.Ping() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected ping not to wait on a commit")
+	}
+	p.journal.mu.Unlock()
+
+	p.journal.Close()
+	if err := ctx.Commit(NewMutation(OpSetBucket,"foo")); err == nil {
+		t.Fatalf("expected a commit to a closed journal to fail")
+	}
+	if err := p.journal.Ping(); err == nil {
+		t.Fatalf("expected ping to report the failed write")
+	}
+}
@@ -43,11 +43,15 @@ func (k ApiKey) IsValid() bool {
 	return true
 }
 
+/* Obf - the first and last 4 characters of a valid key, too little to impersonate a client
+ * but enough to tell keys apart, anything else (a mistyped or forged key) is masked whole */
 func (k ApiKey) Obf() string {
 
-	/* TODO */
 	str := string(k)
-	return fmt.Sprintf("%s..%s..%s",str[:4],str[20:24],str[30:36])
+	if !k.IsValid() {
+		return fmt.Sprintf("****(%d)",len(str))
+	}
+	return str[:4] + ".." + str[32:]
 }
 
 /* Key is just a user supplied string that is not len(0) */
@@ -66,8 +70,13 @@ func (k Key) IsValid() bool {
 	return true
 }
 
+/* Obf - keys are often user names or emails, only the first 2 characters of longer keys
+ * and the length are kept */
 func (k Key) Obf() string {
-	
-	/* TODO */
-	return string(k)
+
+	str := string(k)
+	if len(str) < 8 {
+		return fmt.Sprintf("****(%d)",len(str))
+	}
+	return fmt.Sprintf("%s****(%d)",str[:2],len(str))
 }
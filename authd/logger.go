@@ -0,0 +1,209 @@
+/* authd/authd/logger.go */
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MaxRequestID = 128
+	requestIDBytes = 8
+)
+
+var (
+	LevelInvalid = errors.New("Invalid Log Level")
+	LogFormatInvalid = errors.New("Invalid Log Format")
+
+	logLevel = new(slog.LevelVar)
+	logOutput = &logWriter{out:os.Stderr}
+	logJSON atomic.Bool
+
+	/* Log - the logger of this process, set with -log-level and -log-format */
+	Log = slog.New(newLogHandler(logOutput))
+)
+
+/* ParseLevel - debug, info, warn or error */
+func ParseLevel(s string) (slog.Level,error) {
+
+	for _,l := range []slog.Level{slog.LevelDebug,slog.LevelInfo,slog.LevelWarn,slog.LevelError} {
+		if strings.EqualFold(s,l.String()) {
+			return l,nil
+		}
+	}
+	return slog.LevelInfo,LevelInvalid
+}
+
+func SetLogLevel(level slog.Level) {
+
+	logLevel.Set(level)
+}
+
+func SetLogOutput(w io.Writer) {
+
+	logOutput.mu.Lock()
+	defer logOutput.mu.Unlock()
+	logOutput.out = w
+}
+
+/* SetLogFormat - text (the default) or json */
+func SetLogFormat(format string) error {
+
+	if format != "text" && format != "json" {
+		return LogFormatInvalid
+	}
+	logJSON.Store(format == "json")
+	return nil
+}
+
+/* Fatal - log at error and exit */
+func Fatal(msg string,kv ...interface{}) {
+
+	Log.Error(msg,kv...)
+	os.Exit(1)
+}
+
+/* logWriter - where every line goes, whichever format it is in */
+type logWriter struct {
+
+	mu sync.Mutex
+	out io.Writer
+}
+
+func (w *logWriter) Write(p []byte) (int,error) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.out.Write(p)
+}
+
+/* logHandler - hands each record to the text or json handler as set by SetLogFormat, loggers
+ * derived with With keep their attributes in both */
+type logHandler struct {
+
+	text slog.Handler
+	json slog.Handler
+}
+
+func newLogHandler(w io.Writer) *logHandler {
+
+	opts := &slog.HandlerOptions{Level:logLevel,ReplaceAttr:logAttr}
+	return &logHandler{slog.NewTextHandler(w,opts),slog.NewJSONHandler(w,opts)}
+}
+
+func (h *logHandler) current() slog.Handler {
+
+	if logJSON.Load() {
+		return h.json
+	}
+	return h.text
+}
+
+func (h *logHandler) Enabled(c context.Context,level slog.Level) bool {
+
+	return level >= logLevel.Level()
+}
+
+func (h *logHandler) Handle(c context.Context,r slog.Record) error {
+
+	return h.current().Handle(c,r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+
+	return &logHandler{h.text.WithAttrs(attrs),h.json.WithAttrs(attrs)}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+
+	return &logHandler{h.text.WithGroup(name),h.json.WithGroup(name)}
+}
+
+/* logAttr - levels in lower case and durations as text, as in 1h0m0s */
+func logAttr(groups []string,a slog.Attr) slog.Attr {
+
+	switch {
+	case a.Key == slog.LevelKey && len(groups) == 0:
+		a.Value = slog.StringValue(strings.ToLower(a.Value.String()))
+	case a.Value.Kind() == slog.KindDuration:
+		a.Value = slog.StringValue(a.Value.Duration().String())
+	}
+	return a
+}
+
+type requestIDKey struct{}
+type logKey struct{}
+
+/* RequestID - the id of a request, as sent in X-Request-ID or generated */
+func RequestID(req *http.Request) string {
+
+	id,_ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+/* WithLog - c carrying l, so code running on behalf of a request logs with its request id */
+func WithLog(c context.Context,l *slog.Logger) context.Context {
+
+	return context.WithValue(c,logKey{},l)
+}
+
+/* LogFrom - the logger carried by c, the process logger when there is none */
+func LogFrom(c context.Context) *slog.Logger {
+
+	if l,ok := c.Value(logKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return Log
+}
+
+/* RequestLog - the logger for lines about req, every line carries its request id */
+func RequestLog(req *http.Request) *slog.Logger {
+
+	return LogFrom(req.Context())
+}
+
+/* WithRequestID - middleware accepting the caller's X-Request-ID (if it is sane) or
+ * generating one, the id is echoed in the response so both sides can be correlated */
+func WithRequestID(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+
+		id := req.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID",id)
+		c := context.WithValue(req.Context(),requestIDKey{},id)
+		next.ServeHTTP(w,req.WithContext(WithLog(c,Log.With("request_id",id))))
+	})
+}
+
+/* validRequestID - a caller's id goes into the log and a header so only short, plain ids are taken */
+func validRequestID(id string) bool {
+
+	if id == "" || len(id) > MaxRequestID {
+		return false
+	}
+	for _,c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:",c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+
+	b := make([]byte,requestIDBytes)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,165 @@
+/* authd/authd/logger_test.go */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Logger(t *testing.T) {
+
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	defer SetLogOutput(os.Stderr)
+
+	Log.Debug("not logged")
+	Log.Info("set key","key","al****(17)","bucket","users")
+	Log.With("request_id","abc").Warn("invalid api key","remote","127.0.0.1:1234","error",errors.New("Api Key Not Found"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()),"\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q",lines)
+	}
+	if !strings.HasSuffix(lines[0],`level=info msg="set key" key=al****(17) bucket=users`) {
+		t.Fatalf("incorrect text line %s",lines[0])
+	}
+	if !strings.HasSuffix(lines[1],`level=warn msg="invalid api key" request_id=abc remote=127.0.0.1:1234 error="Api Key Not Found"`) {
+		t.Fatalf("incorrect text line %s",lines[1])
+	}
+
+	buf.Reset()
+	if err := SetLogFormat("xml"); err != LogFormatInvalid {
+		t.Fatalf("expected an invalid format, got %v",err)
+	}
+	SetLogFormat("json")
+	defer SetLogFormat("text")
+	SetLogLevel(slog.LevelDebug)
+	defer SetLogLevel(slog.LevelInfo)
+	Log.With("request_id","abc").Debug("swept expired records","records",3,"grace",time.Hour)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(),&line); err != nil {
+		t.Fatal(err.Error())
+	}
+	if line["level"] != "debug" || line["msg"] != "swept expired records" || line["request_id"] != "abc" ||
+		line["records"] != float64(3) || line["grace"] != "1h0m0s" || line["time"] == nil {
+		t.Fatalf("incorrect json line %v",line)
+	}
+
+	if _,err := ParseLevel("loud"); err != LevelInvalid {
+		t.Fatalf("expected an invalid level, got %v",err)
+	}
+	if l,_ := ParseLevel("WARN"); l != slog.LevelWarn {
+		t.Fatalf("expected warn, got %v",l)
+	}
+}
+
+/* failingStorage - a bucket whose every read fails */
+type failingStorage struct {
+
+	BucketStorage
+}
+
+func (f failingStorage) Get(key Key) (Record,bool,error) {
+
+	return Record{},false,errors.New("disk on fire")
+}
+
+/* a storage error met on behalf of a request is logged with its request id */
+func Test_ContextLog(t *testing.T) {
+
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	defer SetLogOutput(os.Stderr)
+
+	if LogFrom(context.Background()) != Log {
+		t.Fatalf("expected the process logger without a request")
+	}
+
+	ctx,srv := newTestServer(t,"users")
+	defer srv.Close()
+	api,_ := ctx.IssueApiKey(ApiKeyRecord{},SystemActor)
+	b := ctx.GetBucket("users")
+	b.store = failingStorage{b.store}
+
+	req,_ := http.NewRequest("GET",srv.URL + "/api/v1/g/users/alice",nil)
+	req.Header.Add("X-ApiKey",api.String())
+	req.Header.Add("X-Request-ID","login-7f3a")
+	resp,err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 500 {
+		t.Fatalf("expected a storage error to answer 500, got %d",resp.StatusCode)
+	}
+	if !strings.Contains(buf.String(),`msg="check failed" request_id=login-7f3a bucket=users key=`) ||
+		!strings.Contains(buf.String(),`error="disk on fire"`) {
+		t.Fatalf("expected the storage error to carry the request id, got %s",buf.String())
+	}
+}
+
+/* every line about a request carries its id, which the response echoes */
+func Test_RequestID(t *testing.T) {
+
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	SetLogFormat("json")
+	defer SetLogOutput(os.Stderr)
+	defer SetLogFormat("text")
+
+	ctx := NewContext()
+	ctx.Admins.Add("admin",RoleAdmin,DefaultAdminKey)
+	srv := testServer(ctx)
+	defer srv.Close()
+
+	put := func(id string) string {
+
+		req,_ := http.NewRequest("PUT",srv.URL + "/api/v1/g/users",nil)
+		req.Header.Add("X-AdminKey",DefaultAdminKey)
+		if id != "" {
+			req.Header.Add("X-Request-ID",id)
+		}
+		resp,err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Request-ID")
+	}
+
+	if id := put("login-7f3a"); id != "login-7f3a" {
+		t.Fatalf("expected the request id to be echoed, got %q",id)
+	}
+	generated := put("")
+	if len(generated) != 2 * requestIDBytes {
+		t.Fatalf("expected a generated request id, got %q",generated)
+	}
+	if id := put("bad {id}"); id == "bad {id}" || id == "" {
+		t.Fatalf("expected an unusable request id to be replaced, got %q",id)
+	}
+
+	seen := make(map[string]int,0)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(),&line); err != nil {
+			t.Fatalf("expected json lines, got %s",scanner.Text())
+		}
+		id,_ := line["request_id"].(string)
+		seen[id]++
+	}
+	if seen["login-7f3a"] != 2 || seen[generated] != 2 || seen[""] != 0 {
+		t.Fatalf("expected each request's lines to carry its id, got %v",seen)
+	}
+}
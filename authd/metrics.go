@@ -0,0 +1,282 @@
+/* authd/authd/metrics.go */
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	NotLiveResult = "not_live" /* a check refused because the bucket is not live */
+	UnknownBucket = "" /* label for checks on buckets that do not exist, so callers cannot add labels */
+
+	AuthAdmin = "admin"
+	AuthApiKey = "api_key"
+)
+
+var (
+	labelEscaper = strings.NewReplacer(`\`,`\\`,`"`,`\"`,"\n",`\n`)
+
+	/* LatencyBuckets - upper bounds in seconds of the request latency histograms */
+	LatencyBuckets = []float64{.001,.0025,.005,.01,.025,.05,.1,.25,.5,1,2.5,5}
+)
+
+/* metricVec - a counter or histogram family, one series per set of label values */
+type metricVec struct {
+
+	name string
+	help string
+	labels []string
+	buckets []float64 /* histograms only */
+
+	mu sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+
+	values []string
+	count uint64
+	sum float64
+	counts []uint64 /* per bucket, not cumulative */
+}
+
+func newCounterVec(name,help string,labels ...string) *metricVec {
+
+	return &metricVec{name:name,help:help,labels:labels,series:make(map[string]*series,0)}
+}
+
+func newHistogramVec(name,help string,buckets []float64,labels ...string) *metricVec {
+
+	v := newCounterVec(name,help,labels...)
+	v.buckets = buckets
+	return v
+}
+
+func (v *metricVec) get(values []string) *series {
+
+	k := strings.Join(values,"\x00")
+	s,ok := v.series[k]
+	if !ok {
+		s = &series{values:values,counts:make([]uint64,len(v.buckets))}
+		v.series[k] = s
+	}
+	return s
+}
+
+func (v *metricVec) inc(values ...string) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).count++
+}
+
+func (v *metricVec) observe(x float64,values ...string) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s := v.get(values)
+	s.count++
+	s.sum += x
+	for i,le := range v.buckets {
+		if x <= le {
+			s.counts[i]++
+			break
+		}
+	}
+}
+
+/* write - the family in the text exposition format, series in label order */
+func (v *metricVec) write(w io.Writer) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	kind := "counter"
+	if v.buckets != nil {
+		kind = "histogram"
+	}
+	fmt.Fprint(w,"# HELP ",v.name," ",v.help,"\n")
+	fmt.Fprint(w,"# TYPE ",v.name," ",kind,"\n")
+
+	keys := make([]string,0,len(v.series))
+	for k := range v.series {
+		keys = append(keys,k)
+	}
+	sort.Strings(keys)
+
+	for _,k := range keys {
+
+		s := v.series[k]
+		if v.buckets == nil {
+			fmt.Fprint(w,v.name,labelSet(v.labels,s.values),strconv.FormatUint(s.count,10),"\n")
+			continue
+		}
+
+		names := append(append([]string{},v.labels...),"le")
+		values := append(append([]string{},s.values...),"")
+		var cumulative uint64
+		for i,le := range v.buckets {
+			cumulative += s.counts[i]
+			values[len(values) - 1] = formatFloat(le)
+			fmt.Fprint(w,v.name,"_bucket",labelSet(names,values),cumulative,"\n")
+		}
+		values[len(values) - 1] = "+Inf"
+		fmt.Fprint(w,v.name,"_bucket",labelSet(names,values),s.count,"\n")
+		fmt.Fprint(w,v.name,"_sum",labelSet(v.labels,s.values),formatFloat(s.sum),"\n")
+		fmt.Fprint(w,v.name,"_count",labelSet(v.labels,s.values),s.count,"\n")
+	}
+}
+
+/* labelSet - {name="value",...} followed by the space before the sample value */
+func labelSet(names,values []string) string {
+
+	if len(names) == 0 {
+		return " "
+	}
+
+	pairs := make([]string,len(names))
+	for i,n := range names {
+		pairs[i] = n + "=\"" + labelEscaper.Replace(values[i]) + "\""
+	}
+	return "{" + strings.Join(pairs,",") + "} "
+}
+
+func formatFloat(x float64) string {
+
+	if math.IsInf(x,1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(x,'g',-1,64)
+}
+
+/* Metrics - counters and histograms of the traffic authd sees, bucket and record gauges are read
+ * from the context when scraped */
+type Metrics struct {
+
+	checks *metricVec
+	adminOps *metricVec
+	authFailures *metricVec
+	latency *metricVec
+}
+
+/* Check - count a client check decision on bucket */
+func (m *Metrics) Check(bucket Key,result string) {
+
+	if m == nil {
+		return
+	}
+	m.checks.inc(string(bucket),result)
+}
+
+/* AdminOp - count an applied admin change by its mutation op */
+func (m *Metrics) AdminOp(op string) {
+
+	if m == nil {
+		return
+	}
+	m.adminOps.inc(op)
+}
+
+/* AuthFailure - count a refused admin credential (AuthAdmin) or Api Key (AuthApiKey) */
+func (m *Metrics) AuthFailure(kind string) {
+
+	if m == nil {
+		return
+	}
+	m.authFailures.inc(kind)
+}
+
+/* Observe - record how long a request to route took */
+func (m *Metrics) Observe(method,route string,d time.Duration) {
+
+	if m == nil {
+		return
+	}
+	m.latency.observe(d.Seconds(),method,route)
+}
+
+/* Timed - fn with its latency observed under route */
+func (m *Metrics) Timed(route string,fn http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter,req *http.Request) {
+
+		t0 := time.Now()
+		fn(w,req)
+		m.Observe(req.Method,route,time.Since(t0))
+	}
+}
+
+/* Write - every metric of ctx in the text exposition format */
+func (m *Metrics) Write(w io.Writer,ctx *Context) {
+
+	m.checks.write(w)
+	m.adminOps.write(w)
+	m.authFailures.write(w)
+	m.latency.write(w)
+
+	buckets := ctx.BucketList()
+	sort.Slice(buckets,func(i,j int) bool { return buckets[i].Name < buckets[j].Name })
+
+	fmt.Fprint(w,"# HELP authd_buckets Buckets held.\n# TYPE authd_buckets gauge\n")
+	fmt.Fprint(w,"authd_buckets ",len(buckets),"\n")
+	fmt.Fprint(w,"# HELP authd_records Records held per bucket.\n# TYPE authd_records gauge\n")
+	for _,b := range buckets {
+
+		n,err := b.Len()
+		if err != nil {
+			Log.Error("storage error","bucket",b.Name,"error",err)
+			continue
+		}
+		fmt.Fprint(w,"authd_records",labelSet([]string{"bucket"},[]string{string(b.Name)}),n,"\n")
+	}
+	fmt.Fprint(w,"# HELP authd_uptime_seconds Seconds since authd started.\n# TYPE authd_uptime_seconds gauge\n")
+	fmt.Fprint(w,"authd_uptime_seconds ",formatFloat(ctx.Health.Uptime().Seconds()),"\n")
+}
+
+func NewMetrics() *Metrics {
+
+	m := new(Metrics)
+	m.checks = newCounterVec("authd_checks_total","Client checks by bucket and result.","bucket","result")
+	m.adminOps = newCounterVec("authd_admin_operations_total","Admin changes applied by operation.","op")
+	m.authFailures = newCounterVec("authd_auth_failures_total","Refused admin credentials and Api Keys.","kind")
+	m.latency = newHistogramVec("authd_request_duration_seconds","Request latency by route.",LatencyBuckets,"method","route")
+	return m
+}
+
+/* checked - record a client check decision in the audit log and metrics, checks on buckets that do
+ * not exist share one label */
+func (ctx *Context) checked(by Actor,bucket Key,result string) {
+
+	ctx.Audit.Check(by,bucket,result)
+	if ctx.GetBucket(bucket) == nil {
+		bucket = UnknownBucket
+	}
+	ctx.Metrics.Check(bucket,result)
+}
+
+/* refusedResult - the check result for a bucket ClientBucket refused with err */
+func refusedResult(err error) string {
+
+	if err == BucketNotLive {
+		return NotLiveResult
+	}
+	return UnauthorizedResponse
+}
+
+/* Metrics - the metrics in the Prometheus text exposition format, needs an admin credential with read access */
+func MetricsHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
+
+	w.Header().Set("Content-Type",MetricsContentType)
+	ctx.Metrics.Write(w,ctx)
+}
@@ -0,0 +1,96 @@
+/* authd/authd/metrics_test.go */
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_Metrics(t *testing.T) {
+
+	ctx,srv := newTestServer(t)
+	defer srv.Close()
+	api,_ := ctx.IssueApiKey(ApiKeyRecord{},SystemActor)
+
+	run(t,srv,
+		asAdmin("PUT","/api/v1/g/users?enable=yes&allow=" + api.String(),200),
+		asAdmin("PUT","/api/v1/g/closed",200),
+		asAdmin("PUT","/api/v1/g/users/alice",200),
+		apiCall{"PUT","/api/v1/g/users/bob","X-AdminKey","wrong",401},
+		asClient(api,"GET","/api/v1/g/users/alice",200),
+		asClient(api,"GET","/api/v1/g/users/alice",200),
+		asClient(api,"GET","/api/v1/g/users/bob",404),
+		asClient("74602730-7230-5d67-7d60-0400c67e8455","GET","/api/v1/g/users/alice",401),
+		asClient(api,"GET","/api/v1/g/closed/alice",401),
+		asClient(api,"GET","/api/v1/g/made-up-1/alice",401),
+		asClient(api,"GET","/api/v1/g/made-up-2/alice",401))
+
+	ctx.Admins.Add("compliance",RoleAuditor,"auditor-key")
+	req,_ := http.NewRequest("GET",srv.URL + "/metrics",nil)
+	req.Header.Add("X-AdminKey","auditor-key")
+	resp,err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != MetricsContentType {
+		t.Fatalf("incorrect response %d %s",resp.StatusCode,resp.Header.Get("Content-Type"))
+	}
+	body,_ := ioutil.ReadAll(resp.Body)
+	out := string(body)
+
+	for _,expect := range []string{
+		`authd_checks_total{bucket="users",result="yes"} 2`,
+		`authd_checks_total{bucket="users",result="no"} 1`,
+		`authd_checks_total{bucket="users",result="unauthorized"} 1`,
+		`authd_checks_total{bucket="closed",result="not_live"} 1`,
+		`authd_checks_total{bucket="",result="unauthorized"} 2`,
+		`authd_admin_operations_total{op="bucket.enable"} 1`,
+		`authd_admin_operations_total{op="key.set"} 1`,
+		`authd_admin_operations_total{op="apikey.issue"} 1`,
+		`authd_auth_failures_total{kind="admin"} 1`,
+		`authd_auth_failures_total{kind="api_key"} 1`,
+		`authd_request_duration_seconds_count{method="GET",route="/api/v1/g/{bucket}/{key}"} 7`,
+		`authd_request_duration_seconds_bucket{method="GET",route="/api/v1/g/{bucket}/{key}",le="+Inf"} 7`,
+		`authd_buckets 2`,
+		`authd_records{bucket="users"} 1`,
+		"# TYPE authd_request_duration_seconds histogram",
+		"# TYPE authd_records gauge"} {
+
+		if !strings.Contains(out,expect + "\n") {
+			t.Fatalf("expected %s in\n%s",expect,out)
+		}
+	}
+	if strings.Contains(out,"made-up") {
+		t.Fatalf("expected unknown buckets not to become labels")
+	}
+
+	/* the metrics name buckets and count refusals, they are not for anyone to read */
+	run(t,srv,
+		apiCall{"GET","/metrics","","",401},
+		apiCall{"GET","/metrics","X-AdminKey","wrong",401},
+		asClient(api,"GET","/metrics",401))
+}
+
+func Test_MetricsHistogram(t *testing.T) {
+
+	v := newHistogramVec("h","A histogram.",[]float64{.1,1},"route")
+	for _,x := range []float64{.05,.5,.5,2} {
+		v.observe(x,"/a\"b")
+	}
+
+	var buf bytes.Buffer
+	v.write(&buf)
+	expect := "# HELP h A histogram.\n# TYPE h histogram\n" +
+		"h_bucket{route=\"/a\\\"b\",le=\"0.1\"} 1\n" +
+		"h_bucket{route=\"/a\\\"b\",le=\"1\"} 3\n" +
+		"h_bucket{route=\"/a\\\"b\",le=\"+Inf\"} 4\n" +
+		"h_sum{route=\"/a\\\"b\"} 3.05\n" +
+		"h_count{route=\"/a\\\"b\"} 4\n"
+	if buf.String() != expect {
+		t.Fatalf("incorrect histogram\n%s\nexpected\n%s",buf.String(),expect)
+	}
+}
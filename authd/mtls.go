@@ -0,0 +1,171 @@
+/* authd/authd/mtls.go */
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	CertIdentityInvalid = errors.New("Invalid Certificate Identity")
+	ClientCAInvalid = errors.New("Invalid Client CA")
+)
+
+/* CertIdentities - what a verified client certificate stands for, by subject common name,
+ * either an Api Key for the client api or an admin role for the admin api */
+type CertIdentities struct {
+
+	mu sync.RWMutex
+	apiKeys map[string]ApiKey
+	admins map[string]Role
+}
+
+/* AddApiKey - a certificate for subject acts as key on the client api */
+func (ci *CertIdentities) AddApiKey(subject string,key ApiKey) error {
+
+	if subject == "" || !key.IsValid() {
+		return CertIdentityInvalid
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.apiKeys[subject] = key
+	return nil
+}
+
+/* AddAdmin - a certificate for subject is an admin credential named subject with role */
+func (ci *CertIdentities) AddAdmin(subject string,role Role) error {
+
+	if !role.IsValid() {
+		return RoleInvalid
+	}
+	if subject == "" {
+		return CertIdentityInvalid
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.admins[subject] = role
+	return nil
+}
+
+/* ApiKey - the Api Key a request was made with, a verified client certificate mapped to a key
+ * takes the place of X-ApiKey */
+func (ci *CertIdentities) ApiKey(req *http.Request) ApiKey {
+
+	if subject,ok := certSubject(req); ok {
+
+		ci.mu.RLock()
+		key,found := ci.apiKeys[subject]
+		ci.mu.RUnlock()
+		if found {
+			return key
+		}
+	}
+	return ApiKey(req.Header.Get("X-ApiKey"))
+}
+
+/* Admin - the admin credential of a verified client certificate, if it is mapped to a role */
+func (ci *CertIdentities) Admin(req *http.Request) (AdminCredential,bool) {
+
+	subject,ok := certSubject(req)
+	if !ok {
+		return AdminCredential{},false
+	}
+
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	role,found := ci.admins[subject]
+	if !found {
+		return AdminCredential{},false
+	}
+	return AdminCredential{Name:subject,Role:role},true
+}
+
+/* Load - read identities from a file, one per line as "subject apikey api-key" or
+ * "subject admin role", # for comments */
+func (ci *CertIdentities) Load(path string) error {
+
+	f,err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line,"#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d expected \"subject apikey api-key\" or \"subject admin role\"",path,n)
+		}
+
+		switch fields[1] {
+		case "apikey":
+			err = ci.AddApiKey(fields[0],ApiKey(fields[2]))
+		case "admin":
+			err = ci.AddAdmin(fields[0],Role(fields[2]))
+		default:
+			err = CertIdentityInvalid
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d %v",path,n,err)
+		}
+	}
+	return scanner.Err()
+}
+
+func NewCertIdentities() *CertIdentities {
+
+	ci := new(CertIdentities)
+	ci.apiKeys = make(map[string]ApiKey,0)
+	ci.admins = make(map[string]Role,0)
+	return ci
+}
+
+/* certSubject - the common name of a client certificate the tls handshake verified */
+func certSubject(req *http.Request) (string,bool) {
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "",false
+	}
+	cn := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	return cn,cn != ""
+}
+
+/* ClientTLSConfig - ask for client certificates signed by a CA in the caPath bundle, required
+ * or (when optional) verified only if given so header secrets keep working */
+func ClientTLSConfig(caPath string,optional bool) (*tls.Config,error) {
+
+	data,err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil,err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil,ClientCAInvalid
+	}
+
+	config := &tls.Config{ClientCAs:pool,ClientAuth:tls.RequireAndVerifyClientCert}
+	if optional {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config,nil
+}
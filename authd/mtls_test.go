@@ -0,0 +1,232 @@
+/* authd/authd/mtls_test.go */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* testCA - a CA able to sign client certificates for subjects */
+type testCA struct {
+
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+	pem []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+
+	key,err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:big.NewInt(1),
+		Subject:pkix.Name{CommonName:"authd test ca"},
+		NotBefore:time.Now().Add(-time.Hour),
+		NotAfter:time.Now().Add(time.Hour),
+		IsCA:true,
+		KeyUsage:x509.KeyUsageCertSign,
+		BasicConstraintsValid:true,
+	}
+	der,err := x509.CreateCertificate(rand.Reader,tmpl,tmpl,&key.PublicKey,key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert,_ := x509.ParseCertificate(der)
+	return &testCA{cert,key,pemBlock("CERTIFICATE",der)}
+}
+
+func (ca *testCA) client(t *testing.T,subject string) tls.Certificate {
+
+	key,err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:big.NewInt(time.Now().UnixNano()),
+		Subject:pkix.Name{CommonName:subject},
+		NotBefore:time.Now().Add(-time.Hour),
+		NotAfter:time.Now().Add(time.Hour),
+		KeyUsage:x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der,err := x509.CreateCertificate(rand.Reader,tmpl,ca.cert,&key.PublicKey,ca.key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return tls.Certificate{Certificate:[][]byte{der},PrivateKey:key}
+}
+
+func pemBlock(kind string,der []byte) []byte {
+
+	return pem.EncodeToMemory(&pem.Block{Type:kind,Bytes:der})
+}
+
+/* mtlsServer - the api over tls, requiring (or when optional, verifying if given) client
+ * certificates signed by ca */
+func mtlsServer(t *testing.T,ctx *Context,ca *testCA,optional bool) *httptest.Server {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir,"ca.pem")
+	if err := ioutil.WriteFile(path,ca.pem,0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	config,err := ClientTLSConfig(path,optional)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r := mux.NewRouter()
+	NewApiV1Routes(ctx,r,"127.0.0.1:8080")
+	srv := httptest.NewUnstartedServer(r)
+	srv.TLS = config
+	srv.StartTLS()
+	return srv
+}
+
+/* mtlsClient - a client of srv presenting certs */
+func mtlsClient(srv *httptest.Server,certs ...tls.Certificate) *http.Client {
+
+	config := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.Certificates = certs
+	return &http.Client{Transport:&http.Transport{TLSClientConfig:config}}
+}
+
+func mtlsDo(t *testing.T,hc *http.Client,method,url,header,value string) int {
+
+	req,_ := http.NewRequest(method,url,nil)
+	if header != "" {
+		req.Header.Add(header,value)
+	}
+	resp,err := hc.Do(req)
+	if err != nil {
+		return -1
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode
+}
+
+func Test_ClientCertificates(t *testing.T) {
+
+	ca := newTestCA(t)
+	ctx := NewContext()
+	ctx.Admins.Add("admin",RoleAdmin,DefaultAdminKey)
+
+	key,_ := ctx.IssueApiKey(ApiKeyRecord{Label:"gateway"},SystemActor)
+	ctx.Certs.AddApiKey("gateway",key)
+	ctx.Certs.AddAdmin("provisioner",RoleOperator)
+	ctx.Certs.AddAdmin("compliance",RoleAuditor)
+
+	b,_ := ctx.AddBucket("foo")
+	b.Enable()
+	b.AllowApiKey(key)
+	b.Add("bar")
+
+	srv := mtlsServer(t,ctx,ca,false)
+	defer srv.Close()
+
+	gateway := mtlsClient(srv,ca.client(t,"gateway"))
+	provisioner := mtlsClient(srv,ca.client(t,"provisioner"))
+	compliance := mtlsClient(srv,ca.client(t,"compliance"))
+	stranger := mtlsClient(srv,ca.client(t,"stranger"))
+
+	for _,c := range []struct {
+		who string
+		hc *http.Client
+		method,url,header,value string
+		expect int
+	}{
+		{"gateway",gateway,"GET","/api/v1/g/foo/bar","","",200},
+		{"gateway",gateway,"GET","/api/v1/g/foo/tin","","",404},
+		{"gateway",gateway,"PUT","/api/v1/g/foo/tin","","",401},
+		{"provisioner",provisioner,"PUT","/api/v1/g/foo/tin","","",200},
+		{"provisioner",provisioner,"PUT","/api/v1/key","","",403},
+		{"compliance",compliance,"GET","/api/v1/g","","",200},
+		{"compliance",compliance,"DELETE","/api/v1/g/foo/tin","","",403},
+		{"stranger",stranger,"GET","/api/v1/g/foo/bar","","",401},
+		{"stranger",stranger,"GET","/api/v1/g/foo/bar","X-ApiKey",key.String(),200},
+		{"stranger",stranger,"PUT","/api/v1/g/foo/soap","X-AdminKey",DefaultAdminKey,200},
+		{"no certificate",mtlsClient(srv),"GET","/api/v1/g/foo/bar","X-ApiKey",key.String(),-1}} {
+
+		if status := mtlsDo(t,c.hc,c.method,srv.URL + c.url,c.header,c.value); status != c.expect {
+			t.Fatalf("incorrect status %d (%d) - %s %s as %s",status,c.expect,c.method,c.url,c.who)
+		}
+	}
+
+	/* a certificate from another CA is refused outright */
+	other := newTestCA(t)
+	if status := mtlsDo(t,mtlsClient(srv,other.client(t,"gateway")),"GET",srv.URL + "/api/v1/g/foo/bar","",""); status != -1 {
+		t.Fatalf("expected the handshake to fail, got %d",status)
+	}
+}
+
+func Test_ClientCertificatesOptional(t *testing.T) {
+
+	ca := newTestCA(t)
+	ctx := NewContext()
+	key,_ := ctx.IssueApiKey(ApiKeyRecord{},SystemActor)
+	ctx.Certs.AddApiKey("gateway",key)
+	b,_ := ctx.AddBucket("foo")
+	b.Enable()
+	b.Add("bar")
+
+	srv := mtlsServer(t,ctx,ca,true)
+	defer srv.Close()
+
+	if status := mtlsDo(t,mtlsClient(srv),"GET",srv.URL + "/api/v1/g/foo/bar","X-ApiKey",key.String()); status != 200 {
+		t.Fatalf("expected a client without a certificate to use its header, got %d",status)
+	}
+	if status := mtlsDo(t,mtlsClient(srv,ca.client(t,"gateway")),"GET",srv.URL + "/api/v1/g/foo/bar","",""); status != 200 {
+		t.Fatalf("expected the certificate to stand for the api key, got %d",status)
+	}
+}
+
+func Test_CertIdentitiesLoad(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	key,_ := GenerateApiKey(DefaultNamespace)
+	path := filepath.Join(dir,"certs")
+	ioutil.WriteFile(path,[]byte("# gateways\ngateway apikey " + key.String() + "\nops admin operator\n"),0600)
+
+	ci := NewCertIdentities()
+	if err := ci.Load(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ci.apiKeys["gateway"] != key || ci.admins["ops"] != RoleOperator {
+		t.Fatalf("incorrect identities %v %v",ci.apiKeys,ci.admins)
+	}
+
+	for _,bad := range []string{"ops admin root\n","ops apikey not-a-key\n","ops token x\n","ops admin\n"} {
+		ioutil.WriteFile(path,[]byte(bad),0600)
+		if err := NewCertIdentities().Load(path); err == nil {
+			t.Fatalf("expected %q to be refused",bad)
+		}
+	}
+}
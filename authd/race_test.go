@@ -0,0 +1,210 @@
+/* authd/authd/race_test.go
+ * run with -race, hammers the client and admin api in parallel
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	raceWorkers = 8
+	raceRounds = 50
+)
+
+func Test_RaceApi(t *testing.T) {
+
+	ctx := NewContext()
+	ctx.Admins.Add("admin",RoleAdmin,DefaultAdminKey)
+	srv := testServer(ctx)
+	defer srv.Close()
+
+	api,_ := ctx.IssueApiKey(ApiKeyRecord{Label:"race"},SystemActor)
+
+	if _,err := do("PUT",srv.URL + "/api/v1/g/foo?enable=yes","X-AdminKey",DefaultAdminKey); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error,raceWorkers * 3)
+
+	for w := 0; w < raceWorkers; w++ {
+
+		wg.Add(3)
+
+		/* admin: records in and out of a shared bucket */
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < raceRounds; i++ {
+				url := fmt.Sprintf("%s/api/v1/g/foo/key-%d-%d",srv.URL,w,i % 5)
+				for _,method := range []string{"PUT","DELETE"} {
+					if _,err := do(method,url,"X-AdminKey",DefaultAdminKey); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+
+		/* admin: buckets created, enabled, acl changed and dropped */
+		go func(w int) {
+			defer wg.Done()
+			url := fmt.Sprintf("%s/api/v1/g/bar-%d",srv.URL,w % 2)
+			for i := 0; i < raceRounds; i++ {
+				for _,u := range []string{url + "?enable=yes",url + "?allow=" + api.String(),url + "?revoke=" + api.String()} {
+					if _,err := do("PUT",u,"X-AdminKey",DefaultAdminKey); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if _,err := do("DELETE",srv.URL + "/api/v1/key/" + api.String(),"X-AdminKey",DefaultAdminKey); err != nil {
+					errs <- err
+					return
+				}
+				if _,err := do("DELETE",url,"X-AdminKey",DefaultAdminKey); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+
+		/* client: checks against both */
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < raceRounds; i++ {
+				for _,u := range []string{
+					fmt.Sprintf("%s/api/v1/g/foo/key-%d-%d",srv.URL,w,i % 5),
+					fmt.Sprintf("%s/api/v1/g/bar-%d/bar",srv.URL,w % 2),
+					srv.URL + "/api/v1/g/foo"} {
+
+					status,err := do("GET",u,"X-ApiKey",api.String())
+					if err != nil {
+						errs <- err
+						return
+					}
+					if status != 200 && status != 401 && status != 404 {
+						errs <- fmt.Errorf("unexpected status %d for %s",status,u)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err.Error())
+	}
+}
+
+func Test_RaceContext(t *testing.T) {
+
+	ctx := NewContext()
+
+	var wg sync.WaitGroup
+	for w := 0; w < raceWorkers; w++ {
+
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			key,_ := GenerateApiKey(DefaultNamespace)
+			for i := 0; i < raceRounds; i++ {
+
+				b,err := ctx.SetBucket(Key(fmt.Sprintf("b%d",i % 3)))
+				if err != nil {
+					t.Error(err.Error())
+					return
+				}
+				b.Enable()
+				b.Add(Key(fmt.Sprintf("k%d",w)))
+				b.AllowApiKey(key)
+				b.Allowed(key)
+				ctx.RevokeApiKey(key)
+				ctx.Snapshot()
+				b.Del(Key(fmt.Sprintf("k%d",w)))
+				if i % 10 == 0 {
+					ctx.DelBucket(b.Name)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func Test_RaceUseKey(t *testing.T) {
+
+	ctx := NewContext()
+	b,_ := ctx.AddBucket("foo")
+	b.SetRecord("bar",Record{Created:time.Now(),Uses:5})
+
+	var wg sync.WaitGroup
+	used := make(chan bool,raceWorkers * 4)
+	for w := 0; w < raceWorkers * 4; w++ {
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok,_,_ := ctx.UseKey(b,"bar",SystemActor)
+			used <- ok
+		}()
+	}
+	wg.Wait()
+	close(used)
+
+	n := 0
+	for ok := range used {
+		if ok {
+			n++
+		}
+	}
+	if n != 5 {
+		t.Fatalf("expected exactly 5 uses, got %d",n)
+	}
+}
+
+/* records written while a bucket is hashed end up under their digest, never their plaintext key */
+func Test_RaceHash(t *testing.T) {
+
+	ctx := NewContext()
+	ctx.Hasher.SetSecret(testHashSecret)
+	b,_ := ctx.AddBucket("users")
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for w := 0; w < raceWorkers; w++ {
+
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			<- start
+			for i := 0; i < raceRounds * 100; i++ {
+				key := Key(fmt.Sprintf("user-%d-%d@example.com",w,i))
+				b.SetRecord(key,Record{Created:time.Now()})
+			}
+		}(w)
+	}
+	close(start)
+	for n := 0; n < raceWorkers * raceRounds * 10; n,_ = b.Len() {
+		time.Sleep(time.Microsecond)
+	}
+	if err := b.Hash(); err != nil {
+		t.Fatal(err.Error())
+	}
+	wg.Wait()
+
+	if n,_ := b.Len(); n != raceWorkers * raceRounds * 100 {
+		t.Fatalf("expected %d records, got %d",raceWorkers * raceRounds * 100,n)
+	}
+	b.Each(func(k Key,r Record) error {
+		if strings.Contains(string(k),"@") {
+			t.Fatalf("expected only digests, found %s",k)
+		}
+		return nil
+	})
+}
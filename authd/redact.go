@@ -0,0 +1,153 @@
+/* authd/authd/redact.go */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+/* RedactMode - how keys, Api Keys and admin credentials appear in the log */
+type RedactMode string
+
+const (
+	RedactMask = RedactMode("mask") /* the ends of the value, see Obf */
+	RedactHash = RedactMode("hash") /* a short keyed digest, the same value logs the same while the key is */
+	RedactDrop = RedactMode("drop") /* nothing of the value at all */
+
+	Redacted = "[redacted]"
+	redactHashLen = 12 /* hex characters */
+	redactKeyLen = 32 /* bytes */
+)
+
+var (
+	RedactModeInvalid = errors.New("Invalid Redact Mode")
+)
+
+func (m RedactMode) IsValid() bool {
+
+	switch m {
+	case RedactMask,RedactHash,RedactDrop:
+		return true
+	}
+	return false
+}
+
+/* Redactor - every log line about a key, Api Key or admin credential goes through one */
+type Redactor struct {
+
+	mu sync.RWMutex
+	mode RedactMode
+	key []byte /* of the digests, random unless set so a digest cannot be matched to a guessed value */
+}
+
+func (r *Redactor) SetMode(mode RedactMode) error {
+
+	if !mode.IsValid() {
+		return RedactModeInvalid
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mode = mode
+	return nil
+}
+
+/* SetKey - key the digests with a secret, so they stay the same across restarts. The secret is
+ * not used as is, a key of its own is derived from it */
+func (r *Redactor) SetKey(secret []byte) {
+
+	mac := hmac.New(sha256.New,secret)
+	mac.Write([]byte("authd log redaction"))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.key = mac.Sum(nil)
+}
+
+func (r *Redactor) Mode() RedactMode {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mode
+}
+
+func (r *Redactor) redact(value,masked string) string {
+
+	r.mu.RLock()
+	mode,key := r.mode,r.key
+	r.mu.RUnlock()
+
+	switch mode {
+	case RedactMask:
+		return masked
+	case RedactHash:
+		mac := hmac.New(sha256.New,key)
+		mac.Write([]byte(value))
+		return "#" + hex.EncodeToString(mac.Sum(nil))[:redactHashLen]
+	}
+	return Redacted
+}
+
+/* Key - a record key (as given or as stored) for the log */
+func (r *Redactor) Key(k Key) string {
+
+	return r.redact(string(k),k.Obf())
+}
+
+/* ApiKey - an Api Key for the log */
+func (r *Redactor) ApiKey(k ApiKey) string {
+
+	return r.redact(string(k),k.Obf())
+}
+
+/* Path - the path of a routed request with its {key} redacted, a record key under /g and an
+ * Api Key under /key */
+func (r *Redactor) Path(req *http.Request) string {
+
+	vars := mux.Vars(req)
+	key,found := vars["key"]
+	route := mux.CurrentRoute(req)
+	if !found || route == nil {
+		return req.URL.Path
+	}
+	tmpl,err := route.GetPathTemplate()
+	if err != nil {
+		return Redacted
+	}
+
+	redacted := r.ApiKey(ApiKey(key))
+	if _,inBucket := vars["bucket"]; inBucket {
+		redacted = r.Key(Key(key))
+	}
+	return strings.NewReplacer("{bucket}",vars["bucket"],"{key}",redacted).Replace(tmpl)
+}
+
+/* Secret - an admin secret is never logged in any mode, not even a failed attempt */
+func (r *Redactor) Secret(secret string) string {
+
+	return Redacted
+}
+
+func NewRedactor(mode RedactMode) (*Redactor,error) {
+
+	r := new(Redactor)
+	if err := r.SetMode(mode); err != nil {
+		return nil,err
+	}
+	r.key = make([]byte,redactKeyLen)
+	if _,err := rand.Read(r.key); err != nil {
+		return nil,err
+	}
+	return r,nil
+}
+
+/* Redact - the redactor of this process's log, set with -log-redact */
+var Redact,_ = NewRedactor(RedactMask)
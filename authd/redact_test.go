@@ -0,0 +1,99 @@
+/* authd/authd/redact_test.go */
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_Obf(t *testing.T) {
+
+	key := ApiKey("74602730-7230-5d67-7d60-0400c67e8455")
+	if obf := key.Obf(); obf != "7460..8455" {
+		t.Fatalf("incorrect obfuscated api key %s",obf)
+	}
+	if obf := ApiKey("short").Obf(); obf != "****(5)" {
+		t.Fatalf("incorrect obfuscated invalid api key %s",obf)
+	}
+	if obf := Key("alice@example.com").Obf(); obf != "al****(17)" {
+		t.Fatalf("incorrect obfuscated key %s",obf)
+	}
+	if obf := Key("bob").Obf(); obf != "****(3)" {
+		t.Fatalf("incorrect obfuscated short key %s",obf)
+	}
+}
+
+func Test_Redactor(t *testing.T) {
+
+	if _,err := NewRedactor("none"); err != RedactModeInvalid {
+		t.Fatalf("expected an invalid mode, got %v",err)
+	}
+
+	r,_ := NewRedactor(RedactHash)
+	a,b := r.Key("alice@example.com"),r.Key("bob@example.com")
+	if a == b || a != r.Key("alice@example.com") || strings.Contains(a,"al") {
+		t.Fatalf("expected stable distinct digests, got %s %s",a,b)
+	}
+
+	/* keyed, by a random key unless one is set */
+	other,_ := NewRedactor(RedactHash)
+	if other.Key("alice@example.com") == a {
+		t.Fatalf("expected digests keyed apart in each redactor")
+	}
+	r.SetKey(testHashSecret)
+	other.SetKey(testHashSecret)
+	if r.Key("alice@example.com") == a || r.Key("alice@example.com") != other.Key("alice@example.com") {
+		t.Fatalf("expected digests keyed with the secret once it is set")
+	}
+
+	r.SetMode(RedactDrop)
+	if r.Key("alice@example.com") != Redacted || r.ApiKey("74602730-7230-5d67-7d60-0400c67e8455") != Redacted {
+		t.Fatalf("expected everything dropped")
+	}
+
+	r.SetMode(RedactMask)
+	if r.Secret(DefaultAdminKey) != Redacted {
+		t.Fatalf("expected a secret never to be logged")
+	}
+}
+
+/* nothing sensitive reaches the log on the way through the api */
+func Test_RedactedLog(t *testing.T) {
+
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	defer SetLogOutput(os.Stderr)
+
+	ctx := NewContext()
+	ctx.Admins.Add("admin",RoleAdmin,DefaultAdminKey)
+	srv := testServer(ctx)
+	defer srv.Close()
+
+	api,_ := ctx.IssueApiKey(ApiKeyRecord{},SystemActor)
+	for _,c := range []struct {
+		method,url,value string
+		expect int
+	}{
+		{"PUT","/api/v1/g/users","attempted-admin-secret",401},
+		{"PUT","/api/v1/g/users?enable=yes&allow=" + api.String(),DefaultAdminKey,200},
+		{"PUT","/api/v1/g/users/alice@example.com",DefaultAdminKey,200},
+		{"DELETE","/api/v1/g/users/alice@example.com",DefaultAdminKey,200},
+		{"PUT","/api/v1/key/" + api.String() + "/rotate",DefaultAdminKey,200}} {
+
+		if status,_ := do(c.method,srv.URL + c.url,"X-AdminKey",c.value); status != c.expect {
+			t.Fatalf("incorrect status %d (%d) - %s %s",status,c.expect,c.method,c.url)
+		}
+	}
+
+	out := buf.String()
+	for _,secret := range []string{"attempted-admin-secret",DefaultAdminKey,"alice@example.com",api.String()} {
+		if strings.Contains(out,secret) {
+			t.Fatalf("expected %s to be redacted from the log\n%s",secret,out)
+		}
+	}
+	if !strings.Contains(out,"al****(17)") || !strings.Contains(out,api.Obf()) {
+		t.Fatalf("expected the masked key and api key in the log\n%s",out)
+	}
+}
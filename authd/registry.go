@@ -0,0 +1,298 @@
+/* authd/authd/registry.go */
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeStatus = "status" /* ask whether a bucket is empty */
+	ScopeCheck = "check" /* ask whether a bucket holds a key */
+)
+
+var (
+	ApiKeyRevoked = errors.New("Api Key Revoked")
+	ApiKeyNotIssued = errors.New("Api Key Not Issued")
+	ApiKeyExpired = errors.New("Api Key Expired")
+	ApiKeyOutOfScope = errors.New("Api Key Out Of Scope")
+	ScopeInvalid = errors.New("Invalid Scope")
+	ApiKeyAlreadyRotated = errors.New("Api Key Already Rotated")
+)
+
+/* ApiKeyRecord - an Api Key issued by this service, only issued keys that have not been
+ * revoked or expired are accepted from clients, and only within their scope */
+type ApiKeyRecord struct {
+
+	Key ApiKey `json:"key"`
+	Label string `json:"label,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"` /* zero for never */
+	Buckets []string `json:"buckets,omitempty"` /* bucket names, or prefixes ending in '*', empty for all */
+	Actions []string `json:"actions,omitempty"` /* ScopeStatus and/or ScopeCheck, empty for all */
+	Revoked bool `json:"revoked"`
+	RotatedTo ApiKey `json:"rotated_to,omitempty"` /* successor, this key is revoked once it expires */
+}
+
+/* Validate - check the scope of a key about to be issued */
+func (rec ApiKeyRecord) Validate() error {
+
+	for _,pattern := range rec.Buckets {
+		if pattern == "" {
+			return ScopeInvalid
+		}
+	}
+	for _,action := range rec.Actions {
+		if action != ScopeStatus && action != ScopeCheck {
+			return ScopeInvalid
+		}
+	}
+	return nil
+}
+
+/* Permits - may this key perform action on bucket */
+func (rec ApiKeyRecord) Permits(bucket Key,action string) bool {
+
+	if len(rec.Actions) > 0 {
+		found := false
+		for _,a := range rec.Actions {
+			if a == action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(rec.Buckets) == 0 {
+		return true
+	}
+	for _,pattern := range rec.Buckets {
+		if strings.HasSuffix(pattern,"*") {
+			if strings.HasPrefix(string(bucket),pattern[:len(pattern) - 1]) {
+				return true
+			}
+		} else if pattern == string(bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+/* IssueApiKey - generate a new Api Key and record it in the registry, spec holds the label,
+ * expiry and scope, by is who issued it */
+func (ctx *Context) IssueApiKey(spec ApiKeyRecord,by Actor) (ApiKey,error) {
+
+	key,err := GenerateApiKey(ctx.Namespace)
+	if err != nil {
+		return InvalidApiKey,err
+	}
+	if err := ctx.RegisterApiKey(key,spec,by); err != nil {
+		return InvalidApiKey,err
+	}
+	return key,nil
+}
+
+/* RegisterApiKey - record an Api Key generated elsewhere (e.g. before the registry existed) */
+func (ctx *Context) RegisterApiKey(key ApiKey,spec ApiKeyRecord,by Actor) error {
+
+	if !key.IsValid() {
+		return KeyInvalid
+	}
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+
+	return ctx.CommitFunc(func() ([]Mutation,error) {
+
+		if _,exists,err := ctx.store.ApiKey(key); err != nil || exists {
+			if exists {
+				return nil,AlreadyPresent
+			}
+			return nil,err
+		}
+
+		m := NewMutation(OpIssueApiKey,"")
+		m.ApiKey = key
+		m.By = by
+		m.Issued = &spec
+		m.Issued.Key = key
+		m.Issued.Created = m.Time
+		m.Issued.Revoked = false
+		return []Mutation{m},nil
+	})
+}
+
+/* LookupApiKey - find an Api Key in the registry */
+func (ctx *Context) LookupApiKey(key ApiKey) (ApiKeyRecord,bool,error) {
+
+	if !key.IsValid() {
+		return ApiKeyRecord{},false,KeyInvalid
+	}
+	return ctx.store.ApiKey(key)
+}
+
+/* ApiKeyIssued - can a client use this key, it must have been issued, not revoked and not expired */
+func (ctx *Context) ApiKeyIssued(key ApiKey) (bool,error) {
+
+	_,err := ctx.usableApiKey(key)
+	return err == nil,err
+}
+
+/* ApiKeyPermits - can a client use this key to perform action on bucket */
+func (ctx *Context) ApiKeyPermits(key ApiKey,bucket Key,action string) (bool,error) {
+
+	rec,err := ctx.usableApiKey(key)
+	if err != nil {
+		return false,err
+	}
+	if !rec.Permits(bucket,action) {
+		return false,ApiKeyOutOfScope
+	}
+	return true,nil
+}
+
+func (ctx *Context) usableApiKey(key ApiKey) (ApiKeyRecord,error) {
+
+	rec,exists,err := ctx.LookupApiKey(key)
+	if err != nil {
+		return rec,err
+	}
+	if !exists {
+		return rec,ApiKeyNotIssued
+	}
+	if rec.Revoked {
+		return rec,ApiKeyRevoked
+	}
+	if !rec.Expires.IsZero() && !time.Now().Before(rec.Expires) {
+		return rec,ApiKeyExpired
+	}
+	return rec,nil
+}
+
+/* ClientBucket - the bucket a client may perform action on with key, the key must be usable,
+ * have the action and bucket in scope and be allowed by the bucket itself */
+func (ctx *Context) ClientBucket(key ApiKey,bucket Key,action string) (*Bucket,error) {
+
+	b := ctx.GetBucket(bucket)
+	if b == nil {
+		return nil,NotFound
+	}
+	if _,err := ctx.ApiKeyPermits(key,b.Name,action); err != nil {
+		return nil,err
+	}
+	valid,err := b.Allowed(key)
+	if err != nil {
+		return nil,err
+	}
+	if !valid {
+		return nil,ApiKeyNotFound
+	}
+	return b,nil
+}
+
+/* ApiKeyList - every key in the registry */
+func (ctx *Context) ApiKeyList() ([]ApiKeyRecord,error) {
+
+	list := make([]ApiKeyRecord,0)
+	err := ctx.store.EachApiKey(func(rec ApiKeyRecord) error {
+		list = append(list,rec)
+		return nil
+	})
+	return list,err
+}
+
+/* markRevoked - flag a registered key as revoked, unknown keys are left alone */
+func (ctx *Context) markRevoked(key ApiKey) error {
+
+	rec,exists,err := ctx.store.ApiKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	rec.Revoked = true
+	return ctx.store.PutApiKey(rec)
+}
+
+/* RotateApiKey - issue a successor to key with the same label, scope and expiry, allowed on every
+ * bucket key is allowed on. key stays valid for grace and is then revoked by the sweeper */
+func (ctx *Context) RotateApiKey(key ApiKey,grace time.Duration,by Actor) (ApiKey,error) {
+
+	successor,err := GenerateApiKey(ctx.Namespace)
+	if err != nil {
+		return InvalidApiKey,err
+	}
+
+	err = ctx.CommitFunc(func() ([]Mutation,error) {
+
+		rec,err := ctx.usableApiKey(key)
+		if err != nil {
+			return nil,err
+		}
+		if rec.RotatedTo != "" {
+			return nil,ApiKeyAlreadyRotated
+		}
+
+		issue := NewMutation(OpIssueApiKey,"")
+		issue.ApiKey = successor
+		issue.By = by
+		next := rec
+		next.Key = successor
+		next.Created = issue.Time
+		issue.Issued = &next
+
+		ms := []Mutation{issue}
+		for _,b := range ctx.BucketList() {
+			for _,k := range b.ApiKeys() {
+				if k == key {
+					allow := NewMutation(OpAllowApiKey,b.Name)
+					allow.ApiKey = successor
+					allow.By = by
+					ms = append(ms,allow)
+					break
+				}
+			}
+		}
+
+		update := NewMutation(OpUpdateApiKey,"")
+		update.ApiKey = key
+		update.By = by
+		rec.RotatedTo = successor
+		if deadline := issue.Time.Add(grace); rec.Expires.IsZero() || deadline.Before(rec.Expires) {
+			rec.Expires = deadline
+		}
+		update.Issued = &rec
+		return append(ms,update),nil
+	})
+	if err != nil {
+		return InvalidApiKey,err
+	}
+	return successor,nil
+}
+
+/* RevokeRotated - revoke every rotated key whose grace period is over, returning how many */
+func (ctx *Context) RevokeRotated(t time.Time) (int,error) {
+
+	list,err := ctx.ApiKeyList()
+	if err != nil {
+		return 0,err
+	}
+
+	n := 0
+	for _,rec := range list {
+
+		if rec.RotatedTo == "" || rec.Revoked || t.Before(rec.Expires) {
+			continue
+		}
+		m := NewMutation(OpRevokeApiKeyGlobal,"")
+		m.ApiKey = rec.Key
+		m.By = SystemActor
+		if err := ctx.Commit(m); err != nil {
+			return n,err
+		}
+		n++
+	}
+	return n,nil
+}
@@ -5,10 +5,13 @@ package main
 import (
 	"net/http"
 	"flag"
-	"log"
 	"fmt"
 	"errors"
 	"time"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/gorilla/mux"
 )
@@ -17,56 +20,165 @@ var (
 	AlreadyPresent = errors.New("Already Present")
 	NotFound = errors.New("Not Found")
 	KeyInvalid = errors.New("Invalid Key")
+	UnknownOperation = errors.New("Unknown Operation")
 )
 
 const (
 	DefaultAdminKey = "change-me"
 )
 
+var (
+	Version = "0.2.0" /* override with -ldflags "-X main.Version=..." */
+)
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(auditMain(os.Args[2:]))
+	}
+
 	addr := flag.String("addr","127.0.0.1:8080","http service address")
 	namespace := flag.String("ns","namespace.authd.bazaar.technology","Namespace to use for generating ApiKeys")
-	adminKey := flag.String("admin",DefaultAdminKey,"admin key to use")
+	adminKey := flag.String("admin",DefaultAdminKey,"admin key to use, named admin with the admin role, empty for none, the default is refused, or dropped when -admins is given")
+	admins := flag.String("admins","","file of further admin credentials, one \"name role secret\" per line, roles are admin, operator and auditor")
 	tls := flag.Bool("tls",false,"use TLS")
 	cert := flag.String("cert","./cert.pem","certificate")
 	pkey := flag.String("key","./key.pem","private key")
+	level := flag.String("log-level","info","lowest level logged, debug, info, warn or error")
+	format := flag.String("log-format","text","log lines as text or json")
+	redact := flag.String("log-redact","mask","how keys and api keys are logged, mask (the ends), hash (a short digest) or drop, admin secrets are never logged")
+	hashSecret := flag.String("hash-secret","","file holding the secret (at least 16 bytes) for buckets with hashed records")
+	clientCA := flag.String("client-ca","","CA bundle to verify client certificates against, requires -tls")
+	clientOptional := flag.Bool("client-cert-optional",false,"accept clients without a certificate (verifying those that send one)")
+	audit := flag.String("audit","","append-only, hash-chained audit log of admin changes, empty for none")
+	auditKey := flag.String("audit-key","","file holding the key (at least 16 bytes) the audit log is chained with, kept apart from the log")
+	auditChecks := flag.Bool("audit-checks",false,"also audit every client check decision")
+	clientCerts := flag.String("client-certs","","file mapping client certificate subjects to api keys or admin roles, one \"subject apikey api-key\" or \"subject admin role\" per line")
+
+	data := flag.String("data","","directory to persist snapshots in, empty for memory only")
+	interval := flag.Duration("snapshot",5 * time.Minute,"interval between snapshots")
+	store := flag.String("store","memory","bucket storage, memory (snapshot to -data) or file (database in -data)")
+	sweep := flag.Duration("sweep",1 * time.Minute,"interval between evicting expired records and rotated api keys")
+	grace := flag.Duration("grace",24 * time.Hour,"how long a rotated api key stays valid by default")
 
 	showapi := flag.Bool("api",false,"show the api")
 
 	flag.Parse()
 
-	ctx := NewContext()
-	ctx.Namespace = *namespace
-	ctx.AdminKey = *adminKey
-
-	r := mux.NewRouter()
-
-	api := NewApiV1Router(ctx,r,*addr)
+	lvl,err := ParseLevel(*level)
+	if err != nil {
+		Fatal("invalid flag","log-level",*level,"error",err)
+	}
+	SetLogLevel(lvl)
+	if err := SetLogFormat(*format); err != nil {
+		Fatal("invalid flag","log-format",*format,"error",err)
+	}
+	if err := Redact.SetMode(RedactMode(*redact)); err != nil {
+		Fatal("invalid flag","log-redact",*redact,"error",err)
+	}
 
-	/* client api */
-	api.ClientGetCall("/g/{bucket}",ApiV1GetBucketHandler)
-	api.ClientGetCall("/g/{bucket}/{key}",ApiV1GetKeyHandler)
+	var ctx *Context
+	switch *store {
+	case "memory":
+		ctx = NewContext()
+	case "file":
+		if *data == "" {
+			Fatal("file storage requires a -data directory")
+		}
+		if err := os.MkdirAll(*data,0700); err != nil {
+			Fatal("startup failed","error",err)
+		}
+		fs,err := OpenFileStorage(filepath.Join(*data,FileStorageName))
+		if err != nil {
+			Fatal("startup failed","error",err)
+		}
+		if ctx,err = NewContextWithStorage(fs); err != nil {
+			Fatal("startup failed","error",err)
+		}
+	default:
+		Fatal("unknown storage","store",*store)
+	}
+	ctx.Namespace = *namespace
+	if *adminKey == DefaultAdminKey {
+		if *admins == "" {
+			Fatal("startup failed, the default admin key must be changed","flag","-admin")
+		}
+		*adminKey = ""
+	}
+	if *adminKey != "" {
+		ctx.Admins.Add("admin",RoleAdmin,*adminKey)
+	}
+	if *admins != "" {
+		if err := ctx.Admins.Load(*admins); err != nil {
+			Fatal("startup failed","error",err)
+		}
+	}
+	if ctx.Admins.Len() == 0 {
+		Log.Warn("no admin credentials, the admin api is disabled")
+	}
+	ctx.RotationGrace = *grace
+	if *hashSecret != "" {
+		secret,err := LoadHashSecret(*hashSecret)
+		if err != nil {
+			Fatal("startup failed","error",err)
+		}
+		if err := ctx.Hasher.SetSecret(secret); err != nil {
+			Fatal("startup failed","error",err)
+		}
+		Redact.SetKey(secret)
+	}
+	if *clientCerts != "" {
+		if err := ctx.Certs.Load(*clientCerts); err != nil {
+			Fatal("startup failed","error",err)
+		}
+	}
 
-	/* admin api */
-	//s.HandleFunc("/",ctx.admin(ApiV1PutRootHandler)).Methods("PUT") /* allows common tasks */
-	//s.HandleFunc("/",ctx.admin(ApiV1DeleteRootHandler)).Methods("DELETE") /* allows common tasks */
+	/* file storage writes through to disk, snapshots are only needed when in memory */
+	var persist *Persister
+	if *data != "" && *store == "memory" {
 
-	allowed := make(map[string]string,0)
-	allowed["allow"] = "api-key"
-	allowed["revoke"] = "api-key"
-	allowed["enable"] = "yes"
-	allowed["disable"] = "yes"
+		var err error
+		if persist,err = NewPersister(*data,ctx); err != nil {
+			Fatal("startup failed","error",err)
+		}
+		if err = persist.Load(); err != nil {
+			Fatal("startup failed","error",err)
+		}
+		ctx.Health.AddCheck("journal",persist.journal.Ping)
+	}
+	if !ctx.Hasher.Ready() {
+		for _,b := range ctx.BucketList() {
+			if b.IsHashed() {
+				Fatal("hashed records need a -hash-secret","bucket",b.Name)
+			}
+		}
+	}
+	if p,ok := ctx.store.(Pinger); ok {
+		ctx.Health.AddCheck("storage",p.Ping)
+	}
+	if *audit != "" {
 
-	api.AdminPutCall("/g/{bucket}",allowed,ApiV1PutBucketHandler)
-	api.AdminDeleteCall("/g/{bucket}",allowed,ApiV1DeleteBucketHandler)
+		if *auditKey == "" {
+			Fatal("an audit log needs an -audit-key")
+		}
+		key,err := LoadAuditKey(*auditKey)
+		if err != nil {
+			Fatal("startup failed","error",err)
+		}
+		a,err := OpenAuditLog(*audit,key,*auditChecks)
+		if err != nil {
+			Fatal("startup failed","error",err)
+		}
+		ctx.Audit = a
+		ctx.Health.AddCheck("audit",a.Ping)
+		seq,head := a.Head()
+		Log.Info("opened audit log","path",*audit,"seq",seq,"head",head)
+	}
+	ctx.Health.SetLoaded()
 
-	allowed = make(map[string]string,0)
-	api.AdminPutCall("/g/{bucket}/{key}",allowed,ApiV1PutKeyHandler)
-	api.AdminDeleteCall("/g/{bucket}/{key}",allowed,ApiV1DeleteKeyHandler)
+	r := mux.NewRouter()
 
-	api.AdminPutCall("/key",allowed,ApiV1PutApiKeyHandler)
-	api.AdminDeleteCall("/key/{key}",allowed,ApiV1DeleteApiKeyHandler)
+	api := NewApiV1Routes(ctx,r,*addr)
 
 	/* print the api */
 	if *showapi {
@@ -90,13 +202,138 @@ func main() {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
+
+	if persist != nil {
+
+		go persist.Run(*interval)
+	}
+	go shutdown(ctx,persist)
+	go ctx.Sweeper(*sweep)
 	
+	if *clientCA != "" {
+
+		if !*tls {
+			Fatal("-client-ca requires -tls")
+		}
+		config,err := ClientTLSConfig(*clientCA,*clientOptional)
+		if err != nil {
+			Fatal("startup failed","error",err)
+		}
+		srv.TLSConfig = config
+	}
+
 	if *tls {
 		
-		log.Fatal(srv.ListenAndServeTLS(*cert,*pkey))
+		Fatal("serving failed","error",srv.ListenAndServeTLS(*cert,*pkey))
 	} else {
-		log.Fatal(srv.ListenAndServe())
+		Fatal("serving failed","error",srv.ListenAndServe())
+	}
+}
+
+/* NewApiV1Routes - register the full v1 api on r */
+func NewApiV1Routes(ctx *Context,r *mux.Router,addr string) *ApiV1Router {
+
+	api := NewApiV1Router(ctx,r,addr)
+
+	/* service api */
+	api.ServiceGetCall("/status",ApiV1StatusHandler)
+	api.ServiceGetCall("/status/ready",ApiV1ReadyHandler)
+	api.ServiceGetCall("/status/detail",ApiV1StatusDetailHandler)
+
+	/* client api */
+	api.ClientGetCall("/g/{bucket}",ScopeStatus,ApiV1GetBucketHandler)
+	api.ClientGetCall("/g/{bucket}/{key}",ScopeCheck,ApiV1GetKeyHandler)
+	api.ClientPostCall("/check",ApiV1CheckHandler)
+
+	/* admin api */
+	//s.HandleFunc("/",ctx.admin(ApiV1PutRootHandler)).Methods("PUT") /* allows common tasks */
+	//s.HandleFunc("/",ctx.admin(ApiV1DeleteRootHandler)).Methods("DELETE") /* allows common tasks */
+
+	allowed := make(map[string]string,0)
+	allowed["allow"] = "api-key"
+	allowed["revoke"] = "api-key"
+	allowed["enable"] = "yes"
+	allowed["disable"] = "yes"
+	allowed["hash"] = "yes"
+
+	api.AdminPutCall("/g/{bucket}",PermBuckets,allowed,ApiV1PutBucketHandler)
+	api.AdminDeleteCall("/g/{bucket}",PermBuckets,allowed,ApiV1DeleteBucketHandler)
+
+	allowed = make(map[string]string,0)
+	allowed["ttl"] = "duration"
+	allowed["expires"] = "time"
+	allowed["uses"] = "n"
+	api.AdminPutCall("/g/{bucket}/{key}",PermRecords,allowed,ApiV1PutKeyHandler)
+
+	allowed = make(map[string]string,0)
+	api.AdminDeleteCall("/g/{bucket}/{key}",PermRecords,allowed,ApiV1DeleteKeyHandler)
+
+	api.AdminDeleteCall("/key/{key}",PermApiKeys,allowed,ApiV1DeleteApiKeyHandler)
+
+	allowed = make(map[string]string,0)
+	allowed["label"] = "text"
+	allowed["ttl"] = "duration"
+	allowed["expires"] = "time"
+	allowed["bucket"] = "name[*]"
+	allowed["action"] = "status|check"
+	api.AdminPutCall("/key",PermApiKeys,allowed,ApiV1PutApiKeyHandler)
+	api.AdminPutCall("/key/{key}",PermApiKeys,allowed,ApiV1RegisterApiKeyHandler)
+
+	allowed = make(map[string]string,0)
+	allowed["grace"] = "duration"
+	api.AdminPutCall("/key/{key}/rotate",PermApiKeys,allowed,ApiV1RotateApiKeyHandler)
+
+	/* read only admin api */
+	api.AdminGetCall("/g",PermRead,ApiV1ListBucketsHandler)
+	api.AdminGetCall("/key",PermRead,ApiV1ListApiKeysHandler)
+
+	/* prometheus, outside the versioned api where scrapers expect it, with read access to the admin api */
+	r.Handle("/metrics",WithRequestID(http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+
+		req,ok := api.admin(w,req,PermRead)
+		if !ok {
+			return
+		}
+		MetricsHandler(w,req,ctx)
+	}))).Methods("GET")
+	api.api = append(api.api,"GET /metrics")
+	api.curl = append(api.curl,fmt.Sprintf("curl -XGET -H \"X-AdminKey:admin-key\" http://%s/metrics",addr))
+
+	return api
+}
+
+/* shutdown - wait for a termination signal, then take a final snapshot (if any) and
+ * close the storage before exiting */
+func shutdown(ctx *Context,persist *Persister) {
+
+	sig := make(chan os.Signal,1)
+	signal.Notify(sig,os.Interrupt,syscall.SIGTERM)
+	<- sig
+
+	status := 0
+	if persist != nil {
+		if err := persist.Save(); err != nil {
+			Log.Error("final snapshot failed","path",persist.Path(),"error",err)
+			status = 1
+		} else {
+			Log.Info("saved snapshot","path",persist.Path())
+		}
+	}
+	if err := ctx.Close(); err != nil {
+		Log.Error("closing storage failed","error",err)
+		status = 1
+	}
+	if ctx.Audit != nil {
+
+		/* the head goes to the log as well, kept apart from the audit log it shows truncation */
+		seq,head := ctx.Audit.Head()
+		Log.Info("closed audit log","seq",seq,"head",head)
+		if err := ctx.Audit.Close(); err != nil {
+			Log.Error("closing audit log failed","error",err)
+			status = 1
+		}
 	}
+	os.Exit(status)
 }
 
 type ApiV1Router struct {
@@ -109,6 +346,7 @@ type ApiV1Router struct {
 	curl []string
 }
 
+/* ServiceGetCall - a call about the service itself, needs no key */
 func (a *ApiV1Router) ServiceGetCall(url string,fn func(http.ResponseWriter, *http.Request,*Context)) {
 
 	r := func(w http.ResponseWriter,req *http.Request) {
@@ -116,41 +354,43 @@ func (a *ApiV1Router) ServiceGetCall(url string,fn func(http.ResponseWriter, *ht
 		fn(w,req,a.ctx)
 	}
 
+	r = a.ctx.Metrics.Timed("/api/v1" + url,r)
 	a.sr.HandleFunc(url,r).Methods("GET")
-	a.api = append(a.api,fmt.Sprintf("GET %s",url))
-	a.curl = append(a.curl,fmt.Sprintf("curl XGET http://%s/api/v1%s",a.addr,url))
+	a.sr.HandleFunc(url + "/",r).Methods("GET")
+	a.api = append(a.api,fmt.Sprintf("GET /api/v1%s[/]",url))
+	a.curl = append(a.curl,fmt.Sprintf("curl -XGET http://%s/api/v1%s[/]",a.addr,url))
 }
 
-func (a *ApiV1Router) ClientGetCall(url string,fn func(http.ResponseWriter,*http.Request,*Bucket)) {
+/* ClientGetCall - a client call on a bucket, Api Keys must have action in scope */
+func (a *ApiV1Router) ClientGetCall(url string,action string,fn func(http.ResponseWriter,*http.Request,*Context,*Bucket)) {
 
 	r := func(w http.ResponseWriter,req *http.Request) {
 	
 		vars := mux.Vars(req)
 		bucket := vars["bucket"]
-		
-		b := a.ctx.GetBucket(Key(bucket))
-		if b == nil {
-			
+
+		api := a.ctx.Certs.ApiKey(req)
+		b,err := a.ctx.ClientBucket(api,Key(bucket),action)
+		if err != nil {
+
+			/* unknown buckets are not logged, they look the same as a refused key to the client */
+			if action == ScopeCheck {
+				a.ctx.checked(ClientActor(req,api),Key(bucket),refusedResult(err))
+			}
+			if err != NotFound && err != BucketNotLive {
+				a.ctx.Metrics.AuthFailure(AuthApiKey)
+			}
+			if err != NotFound {
+				RequestLog(req).Warn("invalid api key","api_key",Redact.ApiKey(api),"remote",req.RemoteAddr,"error",err)
+			}
 			http.Error(w,"Unauthorized",401)
 			return
 		}
-		
-		api := ApiKey(req.Header.Get("X-ApiKey"))
-		if valid,err := b.Allowed(api); !valid || err != nil {
-			
-			if err != nil {
-				log.Printf("Invalid Api Key %s < %s (%v)\n",api.String(),req.RemoteAddr,err)
-			} else {
-				log.Printf("Invalid Api Key %s < %s\n",api.String(),req.RemoteAddr)
-			}
 
-			http.Error(w,"Unauthorized",401)
-			return
-		}			
-		
-		fn(w,req,b)
+		fn(w,req,a.ctx,b)
 	}
 
+	r = a.ctx.Metrics.Timed("/api/v1" + url,r)
 	a.sr.HandleFunc(url,r).Methods("GET")
 	a.api = append(a.api,fmt.Sprintf("GET /api/v1%s[/]",url))
 	a.curl = append(a.curl,fmt.Sprintf("curl -XGET -H \"X-ApiKey:api-key\" http://%s/api/v1%s[/]",a.addr,url))
@@ -158,16 +398,74 @@ func (a *ApiV1Router) ClientGetCall(url string,fn func(http.ResponseWriter,*http
 	a.sr.HandleFunc(url + "/",r).Methods("GET")
 }
 
-func (a *ApiV1Router) AdminPutCall(url string,allowed map[string]string,
+/* ClientPostCall - a client call carrying its buckets in the body, the handler checks each with ClientBucket */
+func (a *ApiV1Router) ClientPostCall(url string,fn func(http.ResponseWriter,*http.Request,*Context,ApiKey)) {
+
+	r := func(w http.ResponseWriter,req *http.Request) {
+
+		fn(w,req,a.ctx,a.ctx.Certs.ApiKey(req))
+	}
+
+	r = a.ctx.Metrics.Timed("/api/v1" + url,r)
+	a.sr.HandleFunc(url,r).Methods("POST")
+	a.sr.HandleFunc(url + "/",r).Methods("POST")
+	a.api = append(a.api,fmt.Sprintf("POST /api/v1%s[/]",url))
+	a.curl = append(a.curl,fmt.Sprintf("curl -XPOST -H \"X-ApiKey:api-key\" -d '[{\"bucket\":\"b\",\"key\":\"k\"}]' http://%s/api/v1%s[/]",a.addr,url))
+}
+
+/* admin - authenticate an admin call and check the credential's role grants perm */
+func (a *ApiV1Router) admin(w http.ResponseWriter,req *http.Request,perm Permission) (*http.Request,bool) {
+
+	cred,ok := a.ctx.Certs.Admin(req)
+	if !ok {
+		cred,ok = a.ctx.Admins.Authenticate(req.Header.Get("X-AdminKey"))
+	}
+	if !ok {
+
+		a.ctx.Metrics.AuthFailure(AuthAdmin)
+		/* the attempted secret is never logged, it may be a real one with a typo or for another service */
+		RequestLog(req).Warn("invalid admin key","admin_key",Redact.Secret(req.Header.Get("X-AdminKey")),"remote",req.RemoteAddr)
+		http.Error(w,"Unauthorized",401)
+		return req,false
+	}
+
+	if !cred.Role.Can(perm) {
+
+		RequestLog(req).Warn("admin not permitted","admin",cred.Name,"role",cred.Role,"method",req.Method,"path",Redact.Path(req),"remote",req.RemoteAddr)
+		http.Error(w,"Forbidden",403)
+		return req,false
+	}
+
+	RequestLog(req).Info("admin","admin",cred.Name,"role",cred.Role,"method",req.Method,"path",Redact.Path(req),"remote",req.RemoteAddr)
+	return withAdmin(req,cred),true
+}
+
+func (a *ApiV1Router) AdminGetCall(url string,perm Permission,
 	fn func(http.ResponseWriter,*http.Request,*Context)) {
 
 	r := func(w http.ResponseWriter,req *http.Request) {
 
-		adminKey := req.Header.Get("X-AdminKey")
-		if adminKey != a.ctx.AdminKey {
-			
-			log.Printf("Invalid Admin Key %s < %s\n",adminKey,req.RemoteAddr)
-			http.Error(w,"Unauthorized",401)
+		req,ok := a.admin(w,req,perm)
+		if !ok {
+			return
+		}
+		fn(w,req,a.ctx)
+	}
+
+	r = a.ctx.Metrics.Timed("/api/v1" + url,r)
+	a.sr.HandleFunc(url,r).Methods("GET")
+	a.sr.HandleFunc(url + "/",r).Methods("GET")
+	a.api = append(a.api,fmt.Sprintf("GET /api/v1%s[/]",url))
+	a.curl = append(a.curl,fmt.Sprintf("curl -XGET -H \"X-AdminKey:admin-key\" http://%s/api/v1%s[/]",a.addr,url))
+}
+
+func (a *ApiV1Router) AdminPutCall(url string,perm Permission,allowed map[string]string,
+	fn func(http.ResponseWriter,*http.Request,*Context)) {
+
+	r := func(w http.ResponseWriter,req *http.Request) {
+
+		req,ok := a.admin(w,req,perm)
+		if !ok {
 			return
 		}
 		
@@ -176,7 +474,7 @@ func (a *ApiV1Router) AdminPutCall(url string,allowed map[string]string,
 		/* check through all the key=value pairs */
 		for k,_ := range req.Form {
 
-			log.Printf("\t%s ?= %v\n",k,allowed)
+			RequestLog(req).Debug("admin parameter","name",k,"allowed",fmt.Sprint(allowed))
 
 			if _,isallowed := allowed[k]; !isallowed {
 
@@ -202,6 +500,7 @@ func (a *ApiV1Router) AdminPutCall(url string,allowed map[string]string,
 		query = ""
 	}
 
+	r = a.ctx.Metrics.Timed("/api/v1" + url,r)
 	a.sr.HandleFunc(url,r).Methods("PUT")
 	if url != "/" {
 		a.sr.HandleFunc(url + "/",r).Methods("PUT")
@@ -216,16 +515,13 @@ func (a *ApiV1Router) AdminPutCall(url string,allowed map[string]string,
 	}
 }
 
-func (a *ApiV1Router) AdminDeleteCall(url string,allowed map[string]string,
+func (a *ApiV1Router) AdminDeleteCall(url string,perm Permission,allowed map[string]string,
 	fn func(http.ResponseWriter,*http.Request,*Context)) {
 
 	r := func(w http.ResponseWriter,req *http.Request) {
 
-		adminKey := req.Header.Get("X-AdminKey")
-		if adminKey != a.ctx.AdminKey {
-
-			log.Printf("Invalid Admin Key %s < %s\n",adminKey,req.RemoteAddr)
-			http.Error(w,"Unauthorized",401)
+		req,ok := a.admin(w,req,perm)
+		if !ok {
 			return
 		}
 
@@ -256,6 +552,7 @@ func (a *ApiV1Router) AdminDeleteCall(url string,allowed map[string]string,
 		query = ""
 	}
 
+	r = a.ctx.Metrics.Timed("/api/v1" + url,r)
 	a.sr.HandleFunc(url,r).Methods("DELETE")
 	if url != "/" {
 		a.sr.HandleFunc(url + "/",r).Methods("DELETE")
@@ -275,6 +572,7 @@ func NewApiV1Router(ctx *Context,r *mux.Router,addr string) *ApiV1Router {
 
 	a := new(ApiV1Router)
 	a.sr = r.PathPrefix("/api/v1").Subrouter()
+	a.sr.Use(WithRequestID)
 	a.ctx = ctx
 	a.addr = addr
 	a.api = make([]string,0)
@@ -0,0 +1,259 @@
+/* authd/authd/snapshot.go */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	SnapshotVersion = 1
+	SnapshotFile = "snapshot.json"
+)
+
+var (
+	SnapshotVersionUnsupported = errors.New("Unsupported Snapshot Version")
+)
+
+/* Snapshot - versioned on-disk image of a Context, all buckets and their records */
+type Snapshot struct {
+
+	Version int `json:"version"`
+	Created time.Time `json:"created"`
+	Buckets []SnapshotBucket `json:"buckets"`
+	ApiKeys []ApiKeyRecord `json:"issued_api_keys,omitempty"`
+}
+
+type SnapshotBucket struct {
+
+	Name Key `json:"name"`
+	Live bool `json:"live"`
+	Hashed bool `json:"hashed,omitempty"` /* records are keyed by digest */
+	ApiKeyList []ApiKey `json:"api_keys"`
+	Records map[Key]Record `json:"records"` /* by stored key */
+}
+
+/* Snapshot - take a copy of the full context suitable for writing to disk */
+func (ctx *Context) Snapshot() *Snapshot {
+
+	s := new(Snapshot)
+	s.Version = SnapshotVersion
+	s.Created = time.Now()
+	buckets := ctx.BucketList()
+	s.Buckets = make([]SnapshotBucket,0,len(buckets))
+
+	for _,b := range buckets {
+
+		live,err := b.IsLive()
+		if err != nil {
+			Log.Error("storage error","bucket",b.Name,"error",err)
+		}
+		sb := SnapshotBucket{Name:b.Name,Live:live,Hashed:b.IsHashed(),ApiKeyList:b.ApiKeys()}
+		sb.Records = make(map[Key]Record)
+		err = b.Each(func(k Key,r Record) error {
+			sb.Records[k] = r
+			return nil
+		})
+		if err != nil {
+			Log.Error("storage error","bucket",b.Name,"error",err)
+		}
+		s.Buckets = append(s.Buckets,sb)
+	}
+
+	keys,err := ctx.ApiKeyList()
+	if err != nil {
+		Log.Error("storage error","bucket","api keys","error",err)
+	}
+	s.ApiKeys = keys
+	return s
+}
+
+/* Restore - replace all buckets in the context with those held in the snapshot */
+func (ctx *Context) Restore(s *Snapshot) error {
+
+	if s.Version != SnapshotVersion {
+		return SnapshotVersionUnsupported
+	}
+
+	for _,sb := range s.Buckets {
+		if !sb.Name.IsValid() {
+			return KeyInvalid
+		}
+	}
+
+	for _,b := range ctx.BucketList() {
+		if err := ctx.DelBucket(b.Name); err != nil {
+			return err
+		}
+	}
+
+	for _,sb := range s.Buckets {
+
+		b,err := ctx.AddBucket(sb.Name)
+		if err != nil {
+			return err
+		}
+		if err := b.SetLive(sb.Live); err != nil {
+			return err
+		}
+		if err := b.store.SetApiKeys(sb.ApiKeyList); err != nil {
+			return err
+		}
+		if sb.Hashed {
+			if !ctx.Hasher.Ready() {
+				return HashSecretMissing
+			}
+			if err := b.store.SetHashed(true); err != nil {
+				return err
+			}
+		}
+		for k,r := range sb.Records {
+			if err := b.setStored(k,r); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _,rec := range s.ApiKeys {
+		if err := ctx.store.PutApiKey(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* SaveSnapshot - write the snapshot to path, via a temporary file so a crash never leaves a partial image,
+ * the directory is synced too so the rename is durable before the journal is truncated */
+func SaveSnapshot(path string,s *Snapshot) error {
+
+	tmp := path + ".tmp"
+	f,err := os.OpenFile(tmp,os.O_WRONLY|os.O_CREATE|os.O_TRUNC,0600)
+	if err != nil {
+		return err
+	}
+
+	if err = json.NewEncoder(f).Encode(s); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp,path); err != nil {
+		return err
+	}
+
+	dir,err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cerr := dir.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/* LoadSnapshot - read a snapshot previously written by SaveSnapshot */
+func LoadSnapshot(path string) (*Snapshot,error) {
+
+	data,err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil,err
+	}
+
+	s := new(Snapshot)
+	if err := json.Unmarshal(data,s); err != nil {
+		return nil,err
+	}
+	if s.Version != SnapshotVersion {
+		return nil,SnapshotVersionUnsupported
+	}
+	return s,nil
+}
+
+/* Persister - writes snapshots of a context into a data directory, along with a journal
+ * of every mutation committed since the snapshot was taken */
+type Persister struct {
+
+	Dir string
+	ctx *Context
+	journal *Journal
+}
+
+func (p *Persister) Path() string {
+
+	return filepath.Join(p.Dir,SnapshotFile)
+}
+
+/* Load - restore the context from the data directory, replay the journal on top and compact,
+ * a missing snapshot is not an error */
+func (p *Persister) Load() error {
+
+	s,err := LoadSnapshot(p.Path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if s != nil {
+		if err := p.ctx.Restore(s); err != nil {
+			return err
+		}
+		Log.Info("loaded snapshot","path",p.Path(),"buckets",len(s.Buckets),"taken",s.Created)
+	}
+
+	n,err := p.journal.Replay(p.ctx.Apply)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		Log.Info("replayed journal","entries",n)
+	}
+	return p.Save()
+}
+
+/* Save - write a snapshot of the context into the data directory and empty the journal */
+func (p *Persister) Save() error {
+
+	return p.journal.Compact(func() error {
+		return SaveSnapshot(p.Path(),p.ctx.Snapshot())
+	})
+}
+
+/* Run - save a snapshot every interval, never returns */
+func (p *Persister) Run(interval time.Duration) {
+
+	for _ = range time.Tick(interval) {
+
+		if err := p.Save(); err != nil {
+			Log.Error("snapshot failed","path",p.Path(),"error",err)
+		}
+	}
+}
+
+func NewPersister(dir string,ctx *Context) (*Persister,error) {
+
+	if err := os.MkdirAll(dir,0700); err != nil {
+		return nil,err
+	}
+
+	j,err := OpenJournal(filepath.Join(dir,JournalFile))
+	if err != nil {
+		return nil,err
+	}
+
+	p := new(Persister)
+	p.Dir = dir
+	p.ctx = ctx
+	p.journal = j
+	ctx.journal = j
+	ctx.compact = p.Save
+	return p,nil
+}
@@ -0,0 +1,104 @@
+/* authd/authd/snapshot_test.go */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_SnapshotRoundTrip(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	key,_ := GenerateApiKey(DefaultNamespace)
+
+	ctx := NewContext()
+	issued,_ := ctx.IssueApiKey(ApiKeyRecord{Label:"gateway"},SystemActor)
+	b,_ := ctx.AddBucket("foo")
+	b.Enable()
+	b.AllowApiKey(key)
+	b.Add("bar")
+	ctx.AddBucket("soap")
+
+	p,err := NewPersister(dir,ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := p.Save(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	restored := NewContext()
+	p,_ = NewPersister(dir,restored)
+	if err := p.Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(restored.BucketList()) != 2 {
+		t.Fatalf("expected 2 buckets, got %d",len(restored.BucketList()))
+	}
+
+	rb := restored.GetBucket("foo")
+	if rb == nil {
+		t.Fatalf("expected bucket foo")
+	}
+	if live,_ := rb.IsLive(); !live {
+		t.Fatalf("expected bucket foo to be live")
+	}
+	if !rb.Check("bar") {
+		t.Fatalf("expected key bar in bucket foo")
+	}
+	r,_,_ := rb.GetRecord("bar")
+	orig,_,_ := b.GetRecord("bar")
+	if !r.Created.Equal(orig.Created) {
+		t.Fatalf("expected created time to survive the snapshot")
+	}
+	if ok,_ := rb.Allowed(key); !ok {
+		t.Fatalf("expected api key to be allowed")
+	}
+	if ok,_ := restored.ApiKeyIssued(issued); !ok {
+		t.Fatalf("expected issued api key to survive the snapshot")
+	}
+	if live,_ := restored.GetBucket("soap").IsLive(); live {
+		t.Fatalf("expected bucket soap to stay disabled")
+	}
+}
+
+func Test_SnapshotMissing(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	p,_ := NewPersister(dir,NewContext())
+	if err := p.Load(); err != nil {
+		t.Fatalf("expected missing snapshot to be ignored - %v",err)
+	}
+}
+
+func Test_SnapshotVersion(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewContext().Snapshot()
+	s.Version = SnapshotVersion + 1
+
+	p,_ := NewPersister(dir,NewContext())
+	if err := SaveSnapshot(p.Path(),s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := p.Load(); err != SnapshotVersionUnsupported {
+		t.Fatalf("expected unsupported version, got %v",err)
+	}
+}
@@ -0,0 +1,135 @@
+/* authd/authd/status.go */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOkResponse = "ok"
+	StatusNotReadyResponse = "not ready"
+)
+
+/* Health - liveness and readiness of the service */
+type Health struct {
+
+	Started time.Time
+
+	mu sync.RWMutex
+	loaded bool /* state restored, set once startup has finished */
+	checks map[string]func() error
+}
+
+/* SetLoaded - mark startup (snapshot load, journal replay) as done */
+func (h *Health) SetLoaded() {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loaded = true
+}
+
+/* AddCheck - a named readiness check, the service is not ready while it fails */
+func (h *Health) AddCheck(name string,fn func() error) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = fn
+}
+
+/* Ready - run every check, returning whether all passed and the result of each */
+func (h *Health) Ready() (bool,map[string]string) {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ready := h.loaded
+	results := make(map[string]string,len(h.checks) + 1)
+	results["loaded"] = StatusOkResponse
+	if !h.loaded {
+		results["loaded"] = StatusNotReadyResponse
+	}
+
+	for name,fn := range h.checks {
+		if err := fn(); err != nil {
+			results[name] = err.Error()
+			ready = false
+		} else {
+			results[name] = StatusOkResponse
+		}
+	}
+	return ready,results
+}
+
+func (h *Health) Uptime() time.Duration {
+
+	return time.Since(h.Started)
+}
+
+func NewHealth() *Health {
+
+	h := new(Health)
+	h.Started = time.Now()
+	h.checks = make(map[string]func() error,0)
+	return h
+}
+
+/* Pinger - storage that can report whether it is writable */
+type Pinger interface {
+
+	Ping() error
+}
+
+/* Status - liveness, the process is up and serving */
+func ApiV1StatusHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
+
+	fmt.Fprint(w,StatusOkResponse)
+}
+
+/* Ready - readiness, state has been restored and storage is writable */
+func ApiV1ReadyHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
+
+	if ready,_ := ctx.Health.Ready(); !ready {
+
+		http.Error(w,StatusNotReadyResponse,503)
+		return
+	}
+	fmt.Fprint(w,StatusOkResponse)
+}
+
+/* StatusDetail - readiness of each check, uptime, bucket count and version as json */
+func ApiV1StatusDetailHandler(w http.ResponseWriter,req *http.Request,ctx *Context) {
+
+	ready,checks := ctx.Health.Ready()
+
+	detail := struct {
+		Status string `json:"status"`
+		Version string `json:"version"`
+		Started time.Time `json:"started"`
+		Uptime string `json:"uptime"`
+		UptimeSeconds int64 `json:"uptime_seconds"`
+		Buckets int `json:"buckets"`
+		Checks map[string]string `json:"checks"`
+	}{
+		Status:StatusOkResponse,
+		Version:Version,
+		Started:ctx.Health.Started,
+		Uptime:ctx.Health.Uptime().String(),
+		UptimeSeconds:int64(ctx.Health.Uptime() / time.Second),
+		Buckets:len(ctx.BucketList()),
+		Checks:checks,
+	}
+
+	status := 200
+	if !ready {
+		detail.Status = StatusNotReadyResponse
+		status = 503
+	}
+
+	w.Header().Set("Content-Type","application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(detail)
+}
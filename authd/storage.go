@@ -0,0 +1,294 @@
+/* authd/authd/storage.go */
+package main
+
+import (
+	"sync"
+)
+
+/* Storage - where a context keeps its buckets, the Context only holds light
+ * handles so an implementation is free to keep records out of memory */
+type Storage interface {
+
+	Names() ([]Key,error)  /* all existing buckets, used when the context is opened */
+	Open(name Key) (BucketStorage,error)
+	Create(name Key) (BucketStorage,error)
+	Delete(name Key) error
+	Close() error
+
+	/* registry of issued Api Keys */
+	ApiKey(key ApiKey) (ApiKeyRecord,bool,error)
+	PutApiKey(rec ApiKeyRecord) error
+	EachApiKey(fn func(ApiKeyRecord) error) error
+}
+
+/* BucketStorage - the records, live state and access list of a single bucket */
+type BucketStorage interface {
+
+	Get(key Key) (Record,bool,error)
+	Put(key Key,r Record) error
+	Del(key Key) (bool,error)
+	Len() (int,error)
+	Empty() (bool,error) /* cheaper than Len, stops at the first record */
+	Each(fn func(Key,Record) error) error /* fn must not modify the bucket */
+
+	Live() (bool,error)
+	SetLive(live bool) error
+	Hashed() (bool,error) /* records are keyed by digest rather than the key itself */
+	SetHashed(hashed bool) error
+	HashKeys(sum func(Key) (Key,error)) error /* rekey every record by sum and mark the bucket hashed, all at once */
+	ApiKeys() ([]ApiKey,error)
+	SetApiKeys(keys []ApiKey) error
+}
+
+/* MemoryStorage - the default, everything held in maps */
+type MemoryStorage struct {
+
+	mu sync.RWMutex
+	buckets map[Key]*memoryBucket
+	apiKeys map[ApiKey]ApiKeyRecord
+}
+
+type memoryBucket struct {
+
+	mu sync.RWMutex
+	live bool
+	hashed bool
+	apiKeys []ApiKey
+	records map[Key]Record
+}
+
+func (s *MemoryStorage) Names() ([]Key,error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]Key,0,len(s.buckets))
+	for name,_ := range s.buckets {
+		names = append(names,name)
+	}
+	return names,nil
+}
+
+func (s *MemoryStorage) Open(name Key) (BucketStorage,error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if mb,exists := s.buckets[name]; exists {
+		return mb,nil
+	}
+	return nil,NotFound
+}
+
+func (s *MemoryStorage) Create(name Key) (BucketStorage,error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _,exists := s.buckets[name]; exists {
+		return nil,AlreadyPresent
+	}
+
+	mb := new(memoryBucket)
+	mb.apiKeys = make([]ApiKey,0)
+	mb.records = make(map[Key]Record,0)
+	s.buckets[name] = mb
+	return mb,nil
+}
+
+func (s *MemoryStorage) Delete(name Key) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _,exists := s.buckets[name]; !exists {
+		return NotFound
+	}
+	delete(s.buckets,name)
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+
+	return nil
+}
+
+func (s *MemoryStorage) ApiKey(key ApiKey) (ApiKeyRecord,bool,error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec,exists := s.apiKeys[key]
+	return rec,exists,nil
+}
+
+func (s *MemoryStorage) PutApiKey(rec ApiKeyRecord) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apiKeys[rec.Key] = rec
+	return nil
+}
+
+func (s *MemoryStorage) EachApiKey(fn func(ApiKeyRecord) error) error {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _,rec := range s.apiKeys {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mb *memoryBucket) Get(key Key) (Record,bool,error) {
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	r,exists := mb.records[key]
+	return r,exists,nil
+}
+
+func (mb *memoryBucket) Put(key Key,r Record) error {
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.records[key] = r
+	return nil
+}
+
+func (mb *memoryBucket) Del(key Key) (bool,error) {
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if _,exists := mb.records[key]; !exists {
+		return false,nil
+	}
+	delete(mb.records,key)
+	return true,nil
+}
+
+func (mb *memoryBucket) Len() (int,error) {
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	return len(mb.records),nil
+}
+
+func (mb *memoryBucket) Empty() (bool,error) {
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	return len(mb.records) == 0,nil
+}
+
+func (mb *memoryBucket) Each(fn func(Key,Record) error) error {
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	for k,r := range mb.records {
+		if err := fn(k,r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mb *memoryBucket) Live() (bool,error) {
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	return mb.live,nil
+}
+
+func (mb *memoryBucket) SetLive(live bool) error {
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.live = live
+	return nil
+}
+
+func (mb *memoryBucket) Hashed() (bool,error) {
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	return mb.hashed,nil
+}
+
+func (mb *memoryBucket) SetHashed(hashed bool) error {
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.hashed = hashed
+	return nil
+}
+
+/* HashKeys - a record sum gives a new key is moved under it, unless a record is already kept there */
+func (mb *memoryBucket) HashKeys(sum func(Key) (Key,error)) error {
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	digests := make(map[Key]Key,len(mb.records))
+	for k := range mb.records {
+		d,err := sum(k)
+		if err != nil {
+			return err
+		}
+		digests[k] = d
+	}
+
+	records := make(map[Key]Record,len(mb.records))
+	for k,r := range mb.records {
+		if digests[k] == k {
+			records[k] = r
+		}
+	}
+	for k,r := range mb.records {
+		if _,exists := records[digests[k]]; !exists {
+			records[digests[k]] = r
+		}
+	}
+	mb.records = records
+	mb.hashed = true
+	return nil
+}
+
+func (mb *memoryBucket) ApiKeys() ([]ApiKey,error) {
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	return append(make([]ApiKey,0,len(mb.apiKeys)),mb.apiKeys...),nil
+}
+
+func (mb *memoryBucket) SetApiKeys(keys []ApiKey) error {
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.apiKeys = append(make([]ApiKey,0,len(keys)),keys...)
+	return nil
+}
+
+func NewMemoryStorage() *MemoryStorage {
+
+	s := new(MemoryStorage)
+	s.buckets = make(map[Key]*memoryBucket,0)
+	s.apiKeys = make(map[ApiKey]ApiKeyRecord,0)
+	return s
+}
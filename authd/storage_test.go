@@ -0,0 +1,207 @@
+/* authd/authd/storage_test.go */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/* exercise a context over any storage, both implementations must behave the same */
+func testStorage(t *testing.T,store Storage) {
+
+	ctx,err := NewContextWithStorage(store)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b,err := ctx.AddBucket("foo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _,err := ctx.AddBucket("foo"); err != AlreadyPresent {
+		t.Fatalf("expected already present, got %v",err)
+	}
+
+	if !b.Add("bar") {
+		t.Fatalf("expected to add bar")
+	}
+	if b.Add("bar") {
+		t.Fatalf("expected second add of bar to fail")
+	}
+	if !b.Check("bar") || b.Check("tin") {
+		t.Fatalf("expected bar only")
+	}
+	if n,_ := b.Len(); n != 1 {
+		t.Fatalf("expected 1 record, got %d",n)
+	}
+
+	key,_ := GenerateApiKey(DefaultNamespace)
+	b.Enable()
+	if ok,_ := b.Allowed(key); !ok {
+		t.Fatalf("expected global access while the access list is empty")
+	}
+	b.AllowApiKey(key)
+	if b.HasGlobalAccess() {
+		t.Fatalf("expected not to have global access")
+	}
+	if _,err := b.RevokeApiKey(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _,err := b.RevokeApiKey(key); err != ApiKeyNotFound {
+		t.Fatalf("expected api key not found, got %v",err)
+	}
+
+	if !b.Del("bar") || b.Del("bar") {
+		t.Fatalf("expected a single delete of bar to succeed")
+	}
+	if empty,_ := b.IsEmpty(); !empty {
+		t.Fatalf("expected bucket to be empty")
+	}
+
+	if err := ctx.DelBucket("foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ctx.GetBucket("foo") != nil {
+		t.Fatalf("expected bucket foo to be gone")
+	}
+
+	issued,err := ctx.IssueApiKey(ApiKeyRecord{Label:"test"},SystemActor)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok,_ := ctx.ApiKeyIssued(issued); !ok {
+		t.Fatalf("expected issued key to be accepted")
+	}
+	if _,err := ctx.ApiKeyIssued(key); err != ApiKeyNotIssued {
+		t.Fatalf("expected api key not issued, got %v",err)
+	}
+	if err := ctx.Commit(Mutation{Op:OpRevokeApiKeyGlobal,ApiKey:issued}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _,err := ctx.ApiKeyIssued(issued); err != ApiKeyRevoked {
+		t.Fatalf("expected api key revoked, got %v",err)
+	}
+	if list,_ := ctx.ApiKeyList(); len(list) != 1 {
+		t.Fatalf("expected 1 key in the registry, got %d",len(list))
+	}
+}
+
+func Test_MemoryStorage(t *testing.T) {
+
+	testStorage(t,NewMemoryStorage())
+}
+
+func Test_FileStorage(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	fs,err := OpenFileStorage(filepath.Join(dir,FileStorageName))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	testStorage(t,fs)
+	fs.Close()
+}
+
+func Test_FileStorageReopen(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir,FileStorageName)
+	fs,err := OpenFileStorage(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx,_ := NewContextWithStorage(fs)
+	b,_ := ctx.AddBucket("foo")
+	b.Enable()
+	b.Add("bar")
+	b.Add("tin")
+	b.Set("bar")
+	if n,_ := b.Len(); n != 2 {
+		t.Fatalf("expected 2 records, got %d",n)
+	}
+	ctx.Close()
+
+	fs,err = OpenFileStorage(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx,err = NewContextWithStorage(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ctx.Close()
+
+	b = ctx.GetBucket("foo")
+	if b == nil {
+		t.Fatalf("expected bucket foo to survive reopening")
+	}
+	if live,_ := b.IsLive(); !live || !b.Check("bar") {
+		t.Fatalf("expected live bucket foo holding bar")
+	}
+	n,_ := b.Len()
+	empty,_ := b.IsEmpty()
+	if n != 2 || empty {
+		t.Fatalf("expected 2 records to be counted, got %d",n)
+	}
+	b.Del("bar")
+	b.Del("tin")
+	n,_ = b.Len()
+	empty,_ = b.IsEmpty()
+	if n != 0 || !empty {
+		t.Fatalf("expected no records, got %d",n)
+	}
+}
+
+func Test_FileStoragePing(t *testing.T) {
+
+	dir,err := ioutil.TempDir("","authd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir,FileStorageName)
+	fs,err := OpenFileStorage(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _,err := fs.Create("foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _,err := fs.Create("foo"); err != AlreadyPresent || fs.Ping() != nil {
+		t.Fatalf("expected a refused write to leave the storage ready, got %v",fs.Ping())
+	}
+	fs.Close()
+
+	/* as a disk gone read only */
+	db,err := bolt.Open(path,0600,&bolt.Options{ReadOnly:true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fs = &FileStorage{db:db}
+	defer fs.Close()
+
+	if fs.Ping() != nil {
+		t.Fatalf("expected the storage ready before a write fails")
+	}
+	if _,err := fs.Create("bar"); err == nil {
+		t.Fatalf("expected a write to a read only database to fail")
+	}
+	if fs.Ping() == nil {
+		t.Fatalf("expected the storage not ready after a write failed")
+	}
+}
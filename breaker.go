@@ -0,0 +1,111 @@
+/* authd/breaker.go */
+package authd
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/* BreakerState - whether checks are sent to the service */
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota /* checks go to the service */
+	BreakerOpen /* the service is failing, checks fail fast with BreakerTripped */
+	BreakerHalfOpen /* cooled down, the status endpoint is being probed */
+)
+
+var (
+	BreakerTripped = errors.New("Circuit Breaker Open")
+)
+
+func (s BreakerState) String() string {
+
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+/* Breaker - trips after Threshold consecutive failed checks, then fails every check fast for
+ * Cooldown before letting a single caller probe the status endpoint, closing again if it answers */
+type Breaker struct {
+
+	Threshold int /* settings, fixed once the breaker is in use */
+	Cooldown time.Duration
+
+	mu sync.Mutex
+	state BreakerState
+	failures int
+	opened time.Time
+}
+
+/* State - closed, open or half-open, e.g. to show that logins are running degraded */
+func (b *Breaker) State() BreakerState {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && !time.Now().Before(b.opened.Add(b.Cooldown)) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+/* allow - may a check go ahead, probe is true for the one caller that must probe the service first */
+func (b *Breaker) allow() (probe bool,err error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.opened.Add(b.Cooldown)) {
+			return false,BreakerTripped
+		}
+		b.state = BreakerHalfOpen
+		return true,nil
+	case BreakerHalfOpen:
+		return false,BreakerTripped
+	}
+	return false,nil
+}
+
+/* success - the service answered, close the breaker */
+func (b *Breaker) success() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+}
+
+/* failure - the service did not answer, trip once there have been Threshold in a row, or straight
+ * away when a probe failed */
+func (b *Breaker) failure() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		b.state = BreakerOpen
+		b.opened = time.Now()
+	}
+}
+
+/* NewBreaker - a breaker tripping after threshold consecutive failures and probing after cooldown */
+func NewBreaker(threshold int,cooldown time.Duration) *Breaker {
+
+	b := new(Breaker)
+	b.Threshold = threshold
+	b.Cooldown = cooldown
+	return b
+}
@@ -0,0 +1,114 @@
+/* authd/breaker_test.go */
+package authd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Breaker(t *testing.T) {
+
+	b := NewBreaker(3,50 * time.Millisecond)
+
+	b.failure()
+	b.failure()
+	b.success()
+	b.failure()
+	b.failure()
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected closed after non-consecutive failures, got %v",b.State())
+	}
+
+	b.failure()
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open after 3 consecutive failures, got %v",b.State())
+	}
+	if _,err := b.allow(); err != BreakerTripped {
+		t.Fatalf("expected tripped, got %v",err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open after cooling down, got %v",b.State())
+	}
+	if probe,err := b.allow(); !probe || err != nil {
+		t.Fatalf("expected the first caller to probe, got %v %v",probe,err)
+	}
+	if probe,err := b.allow(); probe || err != BreakerTripped {
+		t.Fatalf("expected a single probe, got %v %v",probe,err)
+	}
+
+	/* a failed probe opens the breaker again straight away */
+	b.failure()
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open after a failed probe, got %v",b.State())
+	}
+}
+
+func Test_ClientBreaker(t *testing.T) {
+
+	var up int32
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+
+		atomic.AddInt32(&requests,1)
+		if atomic.LoadInt32(&up) == 0 {
+			http.Error(w,"Service Unavailable",503)
+			return
+		}
+		if req.URL.Path == "/api/v1/status/" {
+			fmt.Fprint(w,"ok")
+			return
+		}
+		fmt.Fprint(w,"yes")
+	}))
+	defer srv.Close()
+
+	cl,err := NewClient(WithAddr(srv.URL),WithRetry(0,0),WithBreaker(NewBreaker(2,100 * time.Millisecond)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		if _,err := cl.Check("soap","bar"); err != UnexpectedResponse {
+			t.Fatalf("expected unexpected response, got %v",err)
+		}
+	}
+	if cl.State() != BreakerOpen {
+		t.Fatalf("expected the breaker to have tripped, got %v",cl.State())
+	}
+
+	n := atomic.LoadInt32(&requests)
+	if _,err := cl.Check("soap","bar"); err != BreakerTripped {
+		t.Fatalf("expected tripped, got %v",err)
+	}
+	if atomic.LoadInt32(&requests) != n {
+		t.Fatalf("expected no request while the breaker is open")
+	}
+
+	/* still down when probed */
+	time.Sleep(120 * time.Millisecond)
+	if cl.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open, got %v",cl.State())
+	}
+	if _,err := cl.Check("soap","bar"); err != BreakerTripped {
+		t.Fatalf("expected tripped after a failed probe, got %v",err)
+	}
+	if cl.State() != BreakerOpen {
+		t.Fatalf("expected open after a failed probe, got %v",cl.State())
+	}
+
+	/* back up */
+	atomic.StoreInt32(&up,1)
+	time.Sleep(120 * time.Millisecond)
+	if ok,err := cl.Check("soap","bar"); !ok || err != nil {
+		t.Fatalf("expecting YES once the probe succeeds, got %v %v",ok,err)
+	}
+	if cl.State() != BreakerClosed {
+		t.Fatalf("expected closed, got %v",cl.State())
+	}
+}
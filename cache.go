@@ -0,0 +1,171 @@
+/* authd/cache.go */
+package authd
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/* Cache - recent check answers, yes is kept for the positive TTL and no for the negative TTL,
+ * the least recently used answer is dropped once the cache is full. Answers are kept per Api Key,
+ * so one client never sees what another was allowed. Only yes and no are cached, a refused Api Key
+ * or an error always goes back to the service, as does an answer sent with no-store, e.g. for
+ * a record with limited uses */
+type Cache struct {
+
+	Size int /* settings, fixed once the cache is in use */
+	Positive time.Duration
+	Negative time.Duration
+
+	mu sync.Mutex
+	lru *list.List /* front is most recently used */
+	entries map[cacheKey]*list.Element
+}
+
+/* cacheKey - an answer is only good for the Api Key it was given to */
+type cacheKey struct {
+
+	apiKey string
+	Pair
+}
+
+type cacheEntry struct {
+
+	key cacheKey
+	found bool
+	expires time.Time
+}
+
+/* Get - a cached answer for bucket/key given to apiKey, ok is false on a miss, a nil cache always misses */
+func (c *Cache) Get(apiKey,bucket,key string) (found bool,ok bool) {
+
+	if c == nil {
+		return false,false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el,exists := c.entries[cacheKey{apiKey,Pair{bucket,key}}]
+	if !exists {
+		return false,false
+	}
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.expires) {
+		c.remove(el)
+		return false,false
+	}
+	c.lru.MoveToFront(el)
+	return e.found,true
+}
+
+/* Put - remember the answer for bucket/key given to apiKey, a zero TTL for the answer disables caching it */
+func (c *Cache) Put(apiKey,bucket,key string,found bool) {
+
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ttl := c.Negative
+	if found {
+		ttl = c.Positive
+	}
+	if ttl <= 0 || c.Size <= 0 {
+		return
+	}
+
+	k := cacheKey{apiKey,Pair{bucket,key}}
+	if el,exists := c.entries[k]; exists {
+		e := el.Value.(*cacheEntry)
+		e.found = found
+		e.expires = time.Now().Add(ttl)
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	for c.lru.Len() >= c.Size {
+		c.remove(c.lru.Back())
+	}
+	c.entries[k] = c.lru.PushFront(&cacheEntry{k,found,time.Now().Add(ttl)})
+}
+
+/* Invalidate - forget every answer for bucket/key, e.g. after changing the record */
+func (c *Cache) Invalidate(bucket,key string) {
+
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k,el := range c.entries {
+		if k.Bucket == bucket && k.Key == key {
+			c.remove(el)
+		}
+	}
+}
+
+/* InvalidateBucket - forget every answer for bucket, e.g. after disabling it or revoking a key on it */
+func (c *Cache) InvalidateBucket(bucket string) {
+
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k,el := range c.entries {
+		if k.Bucket == bucket {
+			c.remove(el)
+		}
+	}
+}
+
+/* Purge - forget every answer */
+func (c *Cache) Purge() {
+
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[cacheKey]*list.Element,c.Size)
+}
+
+func (c *Cache) Len() int {
+
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache) remove(el *list.Element) {
+
+	c.lru.Remove(el)
+	delete(c.entries,el.Value.(*cacheEntry).key)
+}
+
+/* NewCache - a cache of at most size answers, keeping yes for positive and no for negative */
+func NewCache(size int,positive,negative time.Duration) *Cache {
+
+	c := new(Cache)
+	c.Size = size
+	c.Positive = positive
+	c.Negative = negative
+	c.lru = list.New()
+	c.entries = make(map[cacheKey]*list.Element,size)
+	return c
+}
@@ -0,0 +1,162 @@
+/* authd/cache_test.go */
+package authd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_CacheTTL(t *testing.T) {
+
+	c := NewCache(10,200 * time.Millisecond,50 * time.Millisecond)
+
+	c.Put("api","soap","bar",true)
+	c.Put("api","soap","tin",false)
+	if found,ok := c.Get("api","soap","bar"); !ok || !found {
+		t.Fatalf("expected a cached yes for soap/bar")
+	}
+	if found,ok := c.Get("api","soap","tin"); !ok || found {
+		t.Fatalf("expected a cached no for soap/tin")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _,ok := c.Get("api","soap","tin"); ok {
+		t.Fatalf("expected the negative answer to have expired")
+	}
+	if _,ok := c.Get("api","soap","bar"); !ok {
+		t.Fatalf("expected the positive answer to still be cached")
+	}
+
+	off := NewCache(10,time.Minute,0)
+	off.Put("api","soap","tin",false)
+	if off.Len() != 0 {
+		t.Fatalf("expected no negative caching with a zero TTL")
+	}
+
+	var none *Cache
+	none.Put("api","soap","bar",true)
+	if _,ok := none.Get("api","soap","bar"); ok {
+		t.Fatalf("expected a nil cache to always miss")
+	}
+}
+
+func Test_CacheLRU(t *testing.T) {
+
+	c := NewCache(3,time.Minute,time.Minute)
+
+	c.Put("api","b","1",true)
+	c.Put("api","b","2",true)
+	c.Put("api","b","3",true)
+	c.Get("api","b","1") /* 2 is now the least recently used */
+	c.Put("api","b","4",true)
+
+	if c.Len() != 3 {
+		t.Fatalf("expected 3 answers, got %d",c.Len())
+	}
+	if _,ok := c.Get("api","b","2"); ok {
+		t.Fatalf("expected b/2 to have been evicted")
+	}
+	for _,key := range []string{"1","3","4"} {
+		if _,ok := c.Get("api","b",key); !ok {
+			t.Fatalf("expected b/%s to be cached",key)
+		}
+	}
+}
+
+func Test_CacheInvalidate(t *testing.T) {
+
+	c := NewCache(10,time.Minute,time.Minute)
+	c.Put("api","soap","bar",true)
+	c.Put("api","soap","tin",false)
+	c.Put("api","shampoo","bar",true)
+
+	c.Invalidate("soap","bar")
+	if _,ok := c.Get("api","soap","bar"); ok {
+		t.Fatalf("expected soap/bar to be invalidated")
+	}
+
+	c.InvalidateBucket("soap")
+	if _,ok := c.Get("api","soap","tin"); ok {
+		t.Fatalf("expected soap/tin to be invalidated")
+	}
+	if _,ok := c.Get("api","shampoo","bar"); !ok {
+		t.Fatalf("expected shampoo/bar to be untouched")
+	}
+
+	/* an answer given to one Api Key is not an answer for another */
+	c.Put("other","soap","bar",true)
+	if _,ok := c.Get("api","soap","bar"); ok {
+		t.Fatalf("expected no answer for api")
+	}
+	c.Put("api","soap","bar",true)
+	c.Invalidate("soap","bar")
+	if c.Len() != 1 {
+		t.Fatalf("expected soap/bar to be invalidated for every Api Key, got %d",c.Len())
+	}
+
+	c.Purge()
+	if c.Len() != 0 {
+		t.Fatalf("expected an empty cache, got %d",c.Len())
+	}
+}
+
+/* repeated checks are answered from cache, refusals and answers for limited-use records are never cached */
+func Test_ClientCache(t *testing.T) {
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+
+		atomic.AddInt32(&requests,1)
+		switch req.URL.Path {
+		case "/api/v1/g/soap/bar":
+			fmt.Fprint(w,"yes")
+		case "/api/v1/g/soap/tin":
+			http.Error(w,"no",404)
+		case "/api/v1/g/soap/once":
+			w.Header().Set("Cache-Control","no-store")
+			fmt.Fprint(w,"yes")
+		case "/api/v1/check":
+			w.Header().Set("Cache-Control","no-store")
+			fmt.Fprint(w,`[{"bucket":"soap","key":"twice","result":"yes"}]`)
+		default:
+			http.Error(w,"Unauthorized",401)
+		}
+	}))
+	defer srv.Close()
+
+	cl,err := NewClient(WithAddr(srv.URL),WithCache(NewCache(10,time.Minute,time.Minute)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok,err := cl.Check("soap","bar"); !ok || err != nil {
+			t.Fatalf("expecting YES, got %v %v",ok,err)
+		}
+		if ok,err := cl.Check("soap","tin"); ok || err != KeyNotFound {
+			t.Fatalf("expecting key not found, got %v %v",ok,err)
+		}
+		if ok,err := cl.Check("closed","bar"); ok || err != Unauthorized {
+			t.Fatalf("expecting unauthorized, got %v %v",ok,err)
+		}
+		if ok,err := cl.Check("soap","once"); !ok || err != nil {
+			t.Fatalf("expecting YES, got %v %v",ok,err)
+		}
+		if results,err := cl.CheckMany([]Pair{{"soap","twice"}}); err != nil || !results[0].Found {
+			t.Fatalf("expecting YES, got %v %v",results,err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 11 {
+		t.Fatalf("expected 11 requests (2 cached answers, 3 refusals and 6 limited-use answers), got %d",n)
+	}
+
+	cl.Cache.Invalidate("soap","bar")
+	cl.Check("soap","bar")
+	if n := atomic.LoadInt32(&requests); n != 12 {
+		t.Fatalf("expected an invalidated answer to be fetched again, got %d requests",n)
+	}
+}
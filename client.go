@@ -2,12 +2,19 @@
 package authd
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"crypto/x509"
 	"crypto/tls"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"io/ioutil"
 	"fmt"
+	"math/rand"
+	"sync/atomic"
 	"time"
 	"errors"
 )
@@ -17,121 +24,749 @@ var (
 	defaultAddr = "127.0.0.1:8080"
 	defaultTimeout = 5 * time.Second
 	defaultAtLeast = 1 * time.Second /* requests always take at least n */
-	
+	defaultRetries = 0
+	defaultBackoff = 100 * time.Millisecond
+	maxBackoff = 2 * time.Second
+
 	TimeOut = errors.New("Time Out")
+	Unauthorized = errors.New("Unauthorized") /* bad Api Key, unknown bucket or bucket not live */
+	KeyNotFound = errors.New("Key Not Found")
+	UnexpectedResponse = errors.New("Unexpected Response")
+	CheckFailed = errors.New("Check Failed") /* the service could not check one pair of a batch */
+	AddrInvalid = errors.New("Invalid Address")
 
-	c *client
+	c *Client /* default instance behind the package functions */
 )
 
-func request(url string) (int,string,error) {
+/* Client - talks to an authd service through one or more endpoints, safe for concurrent use once configured */
+type Client struct {
+
+	Addr string /* service http address, including the scheme, the first of Endpoints */
+	Endpoints []string /* every service address in order of preference */
+	ApiKey string /* sent as X-ApiKey with every request */
+	Timeout time.Duration
+	AtLeast time.Duration
+	Jitter time.Duration /* random extra padding of up to Jitter on the Auth* checks */
+	HttpClient *http.Client
+	Cache *Cache /* nil for no caching */
+	Breaker *Breaker /* nil to always send checks to the service */
+	Retries int /* extra rounds over every endpoint after none could be reached */
+	Backoff time.Duration /* wait before the first retry, doubled for each one after */
+
+	addrs []string
+	tls *tls.Config
+	certs []tls.Certificate /* client certificates, presented to services that ask for one */
+	current int32 /* index of the endpoint that last answered */
+}
+
+/* Option - configures a client in NewClient */
+type Option func(*Client) error
+
+/* WithAddr - host:port of the service, or a full http:// or https:// url */
+func WithAddr(addr string) Option {
+
+	return func(cl *Client) error {
+		if addr == "" {
+			return AddrInvalid
+		}
+		cl.addrs = []string{addr}
+		return nil
+	}
+}
+
+/* WithEndpoints - several addresses of the same service (as in WithAddr), tried in order when one
+ * is unreachable */
+func WithEndpoints(addrs ...string) Option {
+
+	return func(cl *Client) error {
+		if len(addrs) == 0 {
+			return AddrInvalid
+		}
+		for _,addr := range addrs {
+			if addr == "" {
+				return AddrInvalid
+			}
+		}
+		cl.addrs = addrs
+		return nil
+	}
+}
+
+/* WithRetry - retry a check up to retries more times over every endpoint when none could be reached,
+ * waiting backoff before the first retry and doubling it (with jitter) for each one after, never past
+ * the caller's deadline. A check the service may have seen is never retried, nor is a batch check */
+func WithRetry(retries int,backoff time.Duration) Option {
+
+	return func(cl *Client) error {
+		cl.Retries = retries
+		cl.Backoff = backoff
+		return nil
+	}
+}
+
+/* WithTLS - talk to the service over https using config */
+func WithTLS(config *tls.Config) Option {
+
+	return func(cl *Client) error {
+		cl.tls = config
+		return nil
+	}
+}
+
+/* WithTLSCert - talk to the service over https trusting the PEM certificates in certData,
+ * insecure skips verification (e.g. for a self-signed test cert) */
+func WithTLSCert(certData []byte,insecure bool) Option {
+
+	return func(cl *Client) error {
+
+		certs := x509.NewCertPool()
+		certs.AppendCertsFromPEM(certData)
+		cl.tls = &tls.Config{InsecureSkipVerify:insecure,RootCAs:certs}
+		return nil
+	}
+}
+
+/* WithClientCert - present the PEM certificate and key to the service, it may stand for the Api Key */
+func WithClientCert(certPEM,keyPEM []byte) Option {
+
+	return func(cl *Client) error {
+		cert,err := tls.X509KeyPair(certPEM,keyPEM)
+		if err != nil {
+			return err
+		}
+		cl.certs = append(cl.certs,cert)
+		return nil
+	}
+}
+
+func WithApiKey(key string) Option {
+
+	return func(cl *Client) error {
+		cl.ApiKey = key
+		return nil
+	}
+}
+
+/* WithTimeout - how long the *WithTimeout checks wait for an answer */
+func WithTimeout(d time.Duration) Option {
+
+	return func(cl *Client) error {
+		cl.Timeout = d
+		return nil
+	}
+}
+
+/* WithAtLeast - the minimum duration of the Auth* checks */
+func WithAtLeast(d time.Duration) Option {
+
+	return func(cl *Client) error {
+		cl.AtLeast = d
+		return nil
+	}
+}
+
+/* WithJitter - pad the Auth* checks by a random extra of up to d, on top of the minimum duration */
+func WithJitter(d time.Duration) Option {
+
+	return func(cl *Client) error {
+		cl.Jitter = d
+		return nil
+	}
+}
+
+/* WithCache - answer repeated checks from cache, not for buckets holding records with limited uses */
+func WithCache(cache *Cache) Option {
+
+	return func(cl *Client) error {
+		cl.Cache = cache
+		return nil
+	}
+}
+
+/* WithBreaker - fail checks fast with BreakerTripped while the service is failing */
+func WithBreaker(breaker *Breaker) Option {
+
+	return func(cl *Client) error {
+		cl.Breaker = breaker
+		return nil
+	}
+}
+
+/* WithHttpClient - use hc for every request, its transport is left alone */
+func WithHttpClient(hc *http.Client) Option {
+
+	return func(cl *Client) error {
+		cl.HttpClient = hc
+		return nil
+	}
+}
+
+/* NewClient - a client for the service at WithAddr (default 127.0.0.1:8080) */
+func NewClient(opts ...Option) (*Client,error) {
+
+	cl := new(Client)
+	cl.addrs = []string{defaultAddr}
+	cl.Timeout = defaultTimeout
+	cl.AtLeast = defaultAtLeast
+	cl.Retries = defaultRetries
+	cl.Backoff = defaultBackoff
+
+	for _,opt := range opts {
+		if err := opt(cl); err != nil {
+			return nil,err
+		}
+	}
+
+	if len(cl.certs) > 0 {
+		if cl.tls == nil {
+			cl.tls = &tls.Config{}
+		} else {
+			cl.tls = cl.tls.Clone()
+		}
+		cl.tls.Certificates = append(cl.tls.Certificates,cl.certs...)
+	}
+
+	/* the server name for tls is taken from each endpoint as it is used */
+	for _,addr := range cl.addrs {
+		switch {
+		case strings.Contains(addr,"://"):
+			addr = strings.TrimSuffix(addr,"/")
+		case cl.tls != nil:
+			addr = "https://" + addr
+		default:
+			addr = "http://" + addr
+		}
+		if _,err := url.Parse(addr); err != nil {
+			return nil,AddrInvalid
+		}
+		cl.Endpoints = append(cl.Endpoints,addr)
+	}
+	cl.Addr = cl.Endpoints[0]
+
+	if cl.HttpClient == nil {
+		cl.HttpClient = &http.Client{}
+		if cl.tls != nil {
+			cl.HttpClient.Transport = &http.Transport{TLSClientConfig:cl.tls}
+		}
+	}
+	return cl,nil
+}
+
+/* reply - the status, headers and body the service answered with */
+type reply struct {
+
+	status int
+	header http.Header
+	body string
+}
+
+/* cacheable - the answer may be kept, the service sends no-store for a limited-use record */
+func (r reply) cacheable() bool {
+
+	return !strings.Contains(strings.ToLower(r.header.Get("Cache-Control")),"no-store")
+}
+
+/* request - GET path from the service, cancelled along with ctx in which case ctx.Err() is returned */
+func (cl *Client) request(ctx context.Context,path string) (reply,error) {
+
+	return cl.do(ctx,"GET",path,nil)
+}
+
+/* do - send through the breaker (if any), a transport error, a 5xx or running out of time once every
+ * endpoint and retry has been tried counts as a failure, a cancelled check does not count */
+func (cl *Client) do(ctx context.Context,method,path string,body []byte) (reply,error) {
+
+	if cl.Breaker == nil {
+		return cl.failover(ctx,method,path,body)
+	}
+
+	probe,err := cl.Breaker.allow()
+	if err != nil {
+		return reply{status:-1},err
+	}
+	if probe {
+		if !cl.IsOnlineContext(ctx) {
+			cl.Breaker.failure()
+			return reply{status:-1},BreakerTripped
+		}
+		cl.Breaker.success()
+	}
+
+	r,err := cl.failover(ctx,method,path,body)
+	switch {
+	case err == context.Canceled:
+	case err != nil || r.status >= 500:
+		cl.Breaker.failure()
+	default:
+		cl.Breaker.success()
+	}
+	return r,err
+}
+
+/* failover - send to the endpoint that last answered, failing over to the next only when the request
+ * never reached it, and retrying every endpoint with backoff once none could be reached. A check may
+ * consume a use so anything the service may have seen, a 5xx included, is returned as is. A batch
+ * check is never retried */
+func (cl *Client) failover(ctx context.Context,method,path string,body []byte) (reply,error) {
+
+	var r reply
+	var err error
+
+	retries := cl.Retries
+	if method == "POST" {
+		retries = 0
+	}
+
+	n := len(cl.Endpoints)
+	start := int(atomic.LoadInt32(&cl.current))
+	for attempt := 0; attempt <= retries; attempt++ {
+
+		if attempt > 0 && !cl.backoff(ctx,attempt) {
+			break
+		}
+		for i := 0; i < n; i++ {
+
+			e := (start + i) % n
+			r,err = cl.send(ctx,method,cl.Endpoints[e] + path,body)
+			if ctx.Err() != nil {
+				return reply{status:-1},ctx.Err()
+			}
+			if err == nil && r.status < 500 {
+				atomic.StoreInt32(&cl.current,int32(e))
+			}
+			if !unsent(err) {
+				return r,err
+			}
+		}
+	}
+	return r,err
+}
+
+/* unsent - the connection to the service was never made, so it cannot have seen the request */
+func unsent(err error) bool {
+
+	var op *net.OpError
+	return errors.As(err,&op) && op.Op == "dial"
+}
 
-	resp,err := c.HttpClient.Get(url)
+/* backoff - wait before retry attempt, false when ctx is done or its deadline would pass first */
+func (cl *Client) backoff(ctx context.Context,attempt int) bool {
+
+	d := cl.Backoff << uint(attempt - 1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	d = d / 2 + time.Duration(rand.Int63n(int64(d / 2) + 1))
+
+	if deadline,ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+		return false
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <- t.C:
+		return true
+	case <- ctx.Done():
+		return false
+	}
+}
+
+/* send - a single request to url */
+func (cl *Client) send(ctx context.Context,method,url string,body []byte) (reply,error) {
+
+	req,err := http.NewRequestWithContext(ctx,method,url,bytes.NewReader(body))
 	if err != nil {
-		return -1,"",err
+		return reply{status:-1},err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type","application/json")
+	}
+	if cl.ApiKey != "" {
+		req.Header.Set("X-ApiKey",cl.ApiKey)
+	}
+	if id,ok := ctx.Value(requestIDKey{}).(string); ok {
+		req.Header.Set("X-Request-ID",id)
+	}
+
+	resp,err := cl.HttpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return reply{status:-1},ctx.Err()
+		}
+		return reply{status:-1},err
 	}
 
 	defer resp.Body.Close()
-	body,err := ioutil.ReadAll(resp.Body)
+	r := reply{status:resp.StatusCode,header:resp.Header}
+	data,err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return resp.StatusCode,"",err
+		if ctx.Err() != nil {
+			return r,ctx.Err()
+		}
+		return r,err
+	}
+	r.body = string(data)
+	return r,nil
+}
+
+/* check - ask the service whether bucket holds key, a 401 is Unauthorized and a 404 KeyNotFound */
+func (cl *Client) check(ctx context.Context,bucket,key string) (bool,error) {
+
+	if found,ok := cl.Cache.Get(cl.ApiKey,bucket,key); ok {
+		if !found {
+			return false,KeyNotFound
+		}
+		return true,nil
+	}
+
+	found,cacheable,err := cl.lookup(ctx,bucket,key)
+	if cacheable && (err == nil || err == KeyNotFound) {
+		cl.Cache.Put(cl.ApiKey,bucket,key,found)
 	}
-	return resp.StatusCode,string(body),nil
+	return found,err
 }
 
-func check(addr,bucket,key string) (bool,error) {
+/* lookup - ask the service, also whether the answer may be cached */
+func (cl *Client) lookup(ctx context.Context,bucket,key string) (bool,bool,error) {
 
-	url := fmt.Sprintf("%s/api/v1/check/%s/%s/",addr,bucket,key)
-	status,msg,err := request(url)
+	u := fmt.Sprintf("/api/v1/g/%s/%s",url.PathEscape(bucket),url.PathEscape(key))
+	r,err := cl.request(ctx,u)
 	if err != nil {
-		return false,err
+		return false,false,err
 	}
-	if status != 200 {
-		return false,nil
+
+	switch r.status {
+	case 200:
+		if strings.TrimSpace(strings.ToLower(r.body)) != "yes" {
+			return false,false,UnexpectedResponse
+		}
+		return true,r.cacheable(),nil
+	case 401:
+		return false,false,Unauthorized
+	case 404:
+		return false,r.cacheable(),KeyNotFound
 	}
-	if strings.ToLower(msg) != "yes" {
-		return false,nil
+	return false,false,UnexpectedResponse
+}
+
+/* Pair - a bucket and key to check in CheckMany */
+type Pair struct {
+
+	Bucket string `json:"bucket"`
+	Key string `json:"key"`
+}
+
+/* Result - the answer for one Pair, Err is KeyNotFound, Unauthorized or CheckFailed when not Found */
+type Result struct {
+
+	Pair
+	Found bool
+	Err error
+}
+
+/* checkMany - answer what can be answered from cache and ask the service about the rest of the pairs
+ * in one request, results are in the order of pairs */
+func (cl *Client) checkMany(ctx context.Context,pairs []Pair) ([]Result,error) {
+
+	results := make([]Result,len(pairs))
+	misses := make([]Pair,0,len(pairs))
+	index := make([]int,0,len(pairs))
+	for i,p := range pairs {
+		results[i].Pair = p
+		if found,ok := cl.Cache.Get(cl.ApiKey,p.Bucket,p.Key); ok {
+			results[i].Found = found
+			if !found {
+				results[i].Err = KeyNotFound
+			}
+			continue
+		}
+		misses = append(misses,p)
+		index = append(index,i)
 	}
-	return true,nil
+	if len(misses) == 0 {
+		return results,nil
+	}
+
+	answers,cacheable,err := cl.lookupMany(ctx,misses)
+	if err != nil {
+		return nil,err
+	}
+	for i,a := range answers {
+		results[index[i]] = a
+		if cacheable && (a.Err == nil || a.Err == KeyNotFound) {
+			cl.Cache.Put(cl.ApiKey,a.Bucket,a.Key,a.Found)
+		}
+	}
+	return results,nil
 }
-	
-type response struct {
 
-	checked bool 
-	err error
+/* lookupMany - ask the service about every pair in one request, also whether the answers may be
+ * cached, none are when the batch holds a limited-use record */
+func (cl *Client) lookupMany(ctx context.Context,pairs []Pair) ([]Result,bool,error) {
+
+	body,err := json.Marshal(pairs)
+	if err != nil {
+		return nil,false,err
+	}
+	r,err := cl.do(ctx,"POST","/api/v1/check",body)
+	if err != nil {
+		return nil,false,err
+	}
+	if r.status == 401 {
+		return nil,false,Unauthorized
+	}
+	if r.status != 200 {
+		return nil,false,UnexpectedResponse
+	}
+
+	var answers []struct {
+		Pair
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(r.body),&answers); err != nil || len(answers) != len(pairs) {
+		return nil,false,UnexpectedResponse
+	}
+
+	results := make([]Result,len(answers))
+	for i,a := range answers {
+		results[i].Pair = pairs[i]
+		switch a.Result {
+		case "yes":
+			results[i].Found = true
+		case "no":
+			results[i].Err = KeyNotFound
+		case "unauthorized":
+			results[i].Err = Unauthorized
+		case "error":
+			results[i].Err = CheckFailed
+		default:
+			return nil,false,UnexpectedResponse
+		}
+	}
+	return results,r.cacheable(),nil
 }
 
-func wrap(addr,bucket,key string) chan response {
+/* pad - sleep out whatever is left of floor (plus any jitter) since t0, whatever the outcome of
+ * the check, so the duration of an Auth* check says nothing about it */
+func (cl *Client) pad(t0 time.Time,floor time.Duration) {
 
-	ch := make(chan response,1)
-	go func() {
-		time.Sleep(50 * time.Millisecond)
-		ok,err := check(addr,bucket,key)
-		ch <- response{ok,err}
-	}()
-	return ch
+	if cl.Jitter > 0 {
+		floor += time.Duration(rand.Int63n(int64(cl.Jitter)))
+	}
+	time.Sleep(floor - time.Now().Sub(t0))
 }
 
-type client struct {
+/* authCheck - check, taking at least floor whether the answer is yes, no, an error or a timeout */
+func (cl *Client) authCheck(ctx context.Context,bucket,key string,floor time.Duration) (bool,error) {
 
-	Addr string /* service http address */
-	Timeout time.Duration
-	AtLeast time.Duration
-	HttpClient *http.Client
+	t0 := time.Now()
+	defer cl.pad(t0,floor)
+
+	return cl.check(ctx,bucket,key)
 }
 
-func IsOnline() bool {
+/* timeout - a context for the *WithTimeout checks */
+func (cl *Client) timeout() (context.Context,context.CancelFunc) {
+
+	return context.WithTimeout(context.Background(),cl.Timeout)
+}
+
+func (cl *Client) IsOnline() bool {
+
+	return cl.IsOnlineContext(context.Background())
+}
+
+/* IsOnlineContext - is any endpoint of the service up, the requests are abandoned when ctx is done */
+func (cl *Client) IsOnlineContext(ctx context.Context) bool {
+
+	for _,endpoint := range cl.Endpoints {
+		if cl.online(ctx,endpoint) {
+			return true
+		}
+	}
+	return false
+}
 
-	url := fmt.Sprintf("%s/api/v1/status/",c.Addr)
-	status,msg,err := request(url)
+/* State - the state of the breaker, always closed without one */
+func (cl *Client) State() BreakerState {
+
+	if cl.Breaker == nil {
+		return BreakerClosed
+	}
+	return cl.Breaker.State()
+}
+
+/* EndpointsOnline - whether each endpoint is up, by address */
+func (cl *Client) EndpointsOnline(ctx context.Context) map[string]bool {
+
+	online := make(map[string]bool,len(cl.Endpoints))
+	for _,endpoint := range cl.Endpoints {
+		online[endpoint] = cl.online(ctx,endpoint)
+	}
+	return online
+}
+
+func (cl *Client) online(ctx context.Context,endpoint string) bool {
+
+	r,err := cl.send(ctx,"GET",endpoint + "/api/v1/status/",nil)
 	if err != nil {
 		return false
 	}
-	if status != 200 {
+	if r.status != 200 {
 		return false
 	}
-	if strings.ToLower(msg) != "ok" {
+	if strings.ToLower(r.body) != "ok" {
 		return false
 	}
 	return true
 }
 
-func Check(bucket,key string) (bool,error) {
+func (cl *Client) Check(bucket,key string) (bool,error) {
 
-	return check(c.Addr,bucket,key)
+	return cl.check(context.Background(),bucket,key)
 }
 
-func CheckWithTimeout(bucket,key string) (bool,error) {
+/* CheckContext - Check, the request is abandoned and ctx.Err() returned when ctx is done */
+func (cl *Client) CheckContext(ctx context.Context,bucket,key string) (bool,error) {
 
-	select {
-	case <- time.After(c.Timeout):
+	return cl.check(ctx,bucket,key)
+}
+
+/* CheckMany - check several bucket/key pairs in a single round trip */
+func (cl *Client) CheckMany(pairs []Pair) ([]Result,error) {
+
+	return cl.checkMany(context.Background(),pairs)
+}
+
+func (cl *Client) CheckManyContext(ctx context.Context,pairs []Pair) ([]Result,error) {
+
+	return cl.checkMany(ctx,pairs)
+}
+
+func (cl *Client) CheckWithTimeout(bucket,key string) (bool,error) {
+
+	ctx,cancel := cl.timeout()
+	defer cancel()
+
+	ok,err := cl.check(ctx,bucket,key)
+	if err == context.DeadlineExceeded {
 		return false,TimeOut
-	case rep := <- wrap(c.Addr,bucket,key):
-		return rep.checked,rep.err
 	}
+	return ok,err
 }
 
-func AuthCheck(bucket,key string) (bool,error) {
-		
-	t0 := time.Now()
-	ok,err := check(c.Addr,bucket,key)
-	time.Sleep(c.AtLeast - time.Now().Sub(t0))
+func (cl *Client) AuthCheck(bucket,key string) (bool,error) {
 
-	return ok,err
+	return cl.AuthCheckContext(context.Background(),bucket,key)
 }
 
-func AuthCheckWithTimeout(bucket,key string) (bool,error) {
+/* AuthCheckContext - AuthCheck, the request is abandoned when ctx is done but the call still
+ * takes at least AtLeast */
+func (cl *Client) AuthCheckContext(ctx context.Context,bucket,key string) (bool,error) {
 
-	t0 := time.Now()
-	
-	select {
-	case <- time.After(c.Timeout):
-		/* WARNING: assumption that timeout > atleast */
+	return cl.authCheck(ctx,bucket,key,cl.AtLeast)
+}
+
+/* AuthCheckWithTimeout - every outcome, including a timeout, takes AtLeast, a Timeout longer than
+ * AtLeast is cut to it so the padding never grows to the timeout */
+func (cl *Client) AuthCheckWithTimeout(bucket,key string) (bool,error) {
+
+	d := cl.Timeout
+	if cl.AtLeast > 0 && d > cl.AtLeast {
+		d = cl.AtLeast
+	}
+	ctx,cancel := context.WithTimeout(context.Background(),d)
+	defer cancel()
+
+	ok,err := cl.authCheck(ctx,bucket,key,cl.AtLeast)
+	if err == context.DeadlineExceeded {
 		return false,TimeOut
-	case rep := <- wrap(c.Addr,bucket,key):
-		
-		time.Sleep(c.AtLeast - time.Now().Sub(t0))		
-		return rep.checked,rep.err
 	}
+	return ok,err
+}
+
+type requestIDKey struct{}
+
+/* RequestIDContext - checks made with the returned context send id as X-Request-ID, so authd logs
+ * its decisions under the id of the login attempt they were made for */
+func RequestIDContext(ctx context.Context,id string) context.Context {
+
+	return context.WithValue(ctx,requestIDKey{},id)
+}
+
+/* the package functions below use the default client set up by Start, StartTLS or SetDefault */
+
+/* SetDefault - replace the default client, e.g. to reconfigure in tests */
+func SetDefault(cl *Client) {
+
+	c = cl
+}
+
+/* SetApiKey - the Api Key the default client sends with every check */
+func SetApiKey(key string) {
+
+	c.ApiKey = key
+}
+
+func IsOnline() bool {
+
+	return c.IsOnline()
+}
+
+func IsOnlineContext(ctx context.Context) bool {
+
+	return c.IsOnlineContext(ctx)
+}
+
+func EndpointsOnline(ctx context.Context) map[string]bool {
+
+	return c.EndpointsOnline(ctx)
+}
+
+func State() BreakerState {
+
+	return c.State()
+}
+
+func Check(bucket,key string) (bool,error) {
+
+	return c.Check(bucket,key)
+}
+
+func CheckContext(ctx context.Context,bucket,key string) (bool,error) {
+
+	return c.CheckContext(ctx,bucket,key)
+}
+
+func CheckMany(pairs []Pair) ([]Result,error) {
+
+	return c.CheckMany(pairs)
+}
+
+func CheckManyContext(ctx context.Context,pairs []Pair) ([]Result,error) {
+
+	return c.CheckManyContext(ctx,pairs)
+}
+
+func CheckWithTimeout(bucket,key string) (bool,error) {
+
+	return c.CheckWithTimeout(bucket,key)
+}
+
+func AuthCheck(bucket,key string) (bool,error) {
+
+	return c.AuthCheck(bucket,key)
+}
+
+func AuthCheckContext(ctx context.Context,bucket,key string) (bool,error) {
+
+	return c.AuthCheckContext(ctx,bucket,key)
+}
+
+func AuthCheckWithTimeout(bucket,key string) (bool,error) {
+
+	return c.AuthCheckWithTimeout(bucket,key)
 }
 
 func Start(addr string) bool {
@@ -140,11 +775,11 @@ func Start(addr string) bool {
 		return false
 	}
 
-	c = new(client)
-	c.Addr = "http://" + addr
-	c.Timeout = defaultTimeout
-	c.AtLeast = defaultAtLeast
-	c.HttpClient = &http.Client{}
+	cl,err := NewClient(WithAddr(addr))
+	if err != nil {
+		return false
+	}
+	c = cl
 	return true
 }
 
@@ -154,26 +789,10 @@ func StartTLS(addr string,certData []byte,insecure bool) bool {
 		return false
 	}
 
-	parts := strings.Split(addr,":")
-
-	c = new(client)
-	c.Addr = "https://" + addr
-	c.Timeout = defaultTimeout
-	c.AtLeast = defaultAtLeast
-		
-	config := &tls.Config {InsecureSkipVerify:insecure,ServerName:parts[0]}
-
-	certs := x509.NewCertPool()
-
-	certs.AppendCertsFromPEM(certData)
-	config.RootCAs = certs
-	
-	tr := &http.Transport{
-		TLSClientConfig: config,
+	cl,err := NewClient(WithAddr(addr),WithTLSCert(certData,insecure))
+	if err != nil {
+		return false
 	}
-
-	c.HttpClient = &http.Client{Transport: tr}
-
+	c = cl
 	return true
 }
-
@@ -2,8 +2,22 @@
 package authd
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"fmt"
 	"time"
 	"github.com/gorilla/mux"
@@ -18,6 +32,7 @@ var (
 	key = "./authd/key.pem"
 	insecure = true /* if the cert is self-signed, the test cert is so tell the client to skip verify */
 	addr = "127.0.0.1:8888"
+	apiKey = "74602730-7230-5d67-7d60-0400c67e8455"
 	once = new(sync.Once)
 
 	useTLS = true /* change to true to test TLS version */
@@ -38,6 +53,7 @@ func Test_Offline(t *testing.T) {
 	} else {
 		Start(addr)
 	}
+	SetApiKey(apiKey)
 
 
 	if IsOnline() {
@@ -100,9 +116,9 @@ func Test_ClientCheckNo(t *testing.T) {
 	once.Do(dummy)
 
 	ok,err := Check("soap","tin")
-	if err != nil {
+	if err != KeyNotFound {
 
-		t.Fatalf(err.Error())
+		t.Fatalf("expecting key not found, got %v",err)
 	}
 
 	if ok != false {
@@ -121,9 +137,9 @@ func Test_ClientAuthCheckNo(t *testing.T) {
 	
 	t1 := time.Now()
 	
-	if err != nil {
+	if err != KeyNotFound {
 
-		t.Fatalf(err.Error())
+		t.Fatalf("expecting key not found, got %v",err)
 	}
 
 	if ok != false {
@@ -137,6 +153,144 @@ func Test_ClientAuthCheckNo(t *testing.T) {
 		
 }
 
+func Test_ClientUnauthorized(t *testing.T) {
+
+	once.Do(dummy)
+
+	/* bucket not live */
+	if ok,err := Check("closed","bar"); ok || err != Unauthorized {
+
+		t.Fatalf("expecting unauthorized, got %v %v",ok,err)
+	}
+
+	SetApiKey("00000000-0000-0000-0000-000000000000")
+	defer SetApiKey(apiKey)
+
+	if ok,err := Check("soap","bar"); ok || err != Unauthorized {
+
+		t.Fatalf("expecting unauthorized, got %v %v",ok,err)
+	}
+}
+
+func Test_NewClient(t *testing.T) {
+
+	cl,err := NewClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if cl.Addr != "http://" + defaultAddr || cl.Timeout != defaultTimeout || cl.AtLeast != defaultAtLeast {
+		t.Fatalf("incorrect defaults %s %v %v",cl.Addr,cl.Timeout,cl.AtLeast)
+	}
+
+	cl,err = NewClient(WithAddr("auth.example.com:443"),WithTLS(&tls.Config{}),WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if cl.Addr != "https://auth.example.com:443" || cl.Timeout != time.Second {
+		t.Fatalf("incorrect client %s %v",cl.Addr,cl.Timeout)
+	}
+
+	if _,err := NewClient(WithAddr("")); err != AddrInvalid {
+		t.Fatalf("expected invalid address, got %v",err)
+	}
+}
+
+/* two clients with different Api Keys against the same service, neither affects the other */
+func Test_ClientInstances(t *testing.T) {
+
+	once.Do(dummy)
+
+	opts := []Option{WithAddr(addr),WithAtLeast(0)}
+	if useTLS {
+		data,err := ioutil.ReadFile(cert)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		opts = append(opts,WithTLSCert(data,insecure))
+	}
+
+	good,err := NewClient(append(opts,WithApiKey(apiKey))...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bad,err := NewClient(append(opts,WithApiKey("00000000-0000-0000-0000-000000000000"))...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if ok,err := good.Check("soap","bar"); !ok || err != nil {
+		t.Fatalf("expecting YES, got %v %v",ok,err)
+	}
+	if ok,err := bad.AuthCheck("soap","bar"); ok || err != Unauthorized {
+		t.Fatalf("expecting unauthorized, got %v %v",ok,err)
+	}
+	if !bad.IsOnline() {
+		t.Fatalf("service offline")
+	}
+}
+
+func Test_ClientRequestID(t *testing.T) {
+
+	var got atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+
+		got.Store(req.Header.Get("X-Request-ID"))
+		fmt.Fprint(w,"yes")
+	}))
+	defer srv.Close()
+
+	cl,err := NewClient(WithAddr(srv.URL))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _,err := cl.CheckContext(RequestIDContext(context.Background(),"login-7f3a"),"soap","bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if id := got.Load(); id != "login-7f3a" {
+		t.Fatalf("expected the request id to be sent, got %v",id)
+	}
+	cl.Check("soap","bar")
+	if id := got.Load(); id != "" {
+		t.Fatalf("expected no request id, got %v",id)
+	}
+}
+
+func Test_ClientContext(t *testing.T) {
+
+	once.Do(dummy)
+
+	ctx,cancel := context.WithCancel(context.Background())
+	cancel()
+	if ok,err := CheckContext(ctx,"soap","bar"); ok || err != context.Canceled {
+		t.Fatalf("expecting canceled, got %v %v",ok,err)
+	}
+	if IsOnlineContext(ctx) {
+		t.Fatalf("expecting a canceled status request to fail")
+	}
+
+	/* the slow key is abandoned at the deadline rather than the client timeout */
+	ctx,cancel = context.WithTimeout(context.Background(),100 * time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	if _,err := CheckContext(ctx,"soap","bubble"); err != context.DeadlineExceeded {
+		t.Fatalf("expecting deadline exceeded, got %v",err)
+	}
+	if d := time.Since(t0); d > c.Timeout / 2 {
+		t.Fatalf("request was not cancelled at the deadline - took %v",d)
+	}
+
+	/* but an auth check still takes at least the required time */
+	ctx,cancel = context.WithTimeout(context.Background(),100 * time.Millisecond)
+	defer cancel()
+	t0 = time.Now()
+	if _,err := AuthCheckContext(ctx,"soap","bubble"); err != context.DeadlineExceeded {
+		t.Fatalf("expecting deadline exceeded, got %v",err)
+	}
+	if d := time.Since(t0); d < c.AtLeast {
+		t.Fatalf("did not take at least the required time - took %v",d)
+	}
+}
+
 func Test_ClientCheckTimeout(t *testing.T) {
 
 	once.Do(dummy)
@@ -201,6 +355,353 @@ func Test_ClientAuthCheckTimeoutError(t *testing.T) {
 	}
 }
 
+/* timingServer - answers yes for bar, no for tin, 401 for closed and takes too long for slow,
+ * along with batch checks and status */
+func timingServer() *httptest.Server {
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/g/{bucket}/{key}",func(w http.ResponseWriter,req *http.Request) {
+
+		vars := mux.Vars(req)
+		switch {
+		case vars["bucket"] == "closed":
+			http.Error(w,"Unauthorized",401)
+		case vars["key"] == "tin":
+			http.Error(w,"no",404)
+		case vars["key"] == "slow":
+			select {
+			case <- time.After(time.Second):
+			case <- req.Context().Done():
+			}
+		default:
+			fmt.Fprint(w,"yes")
+		}
+	})
+	r.HandleFunc("/api/v1/check",func(w http.ResponseWriter,req *http.Request) {
+
+		var pairs []map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&pairs); err != nil {
+			http.Error(w,"Invalid Batch",400)
+			return
+		}
+		for _,p := range pairs {
+			switch {
+			case p["bucket"] == "closed":
+				p["result"] = "unauthorized"
+			case p["key"] == "tin":
+				p["result"] = "no"
+			case p["key"] == "broken":
+				p["result"] = "error"
+			default:
+				p["result"] = "yes"
+			}
+		}
+		json.NewEncoder(w).Encode(pairs)
+	}).Methods("POST")
+	r.HandleFunc("/api/v1/status/",StatusHandler)
+	return httptest.NewServer(r)
+}
+
+func Test_ClientCheckMany(t *testing.T) {
+
+	srv := timingServer()
+	defer srv.Close()
+
+	cl,err := NewClient(WithAddr(srv.URL),WithApiKey(apiKey))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	results,err := cl.CheckMany([]Pair{{"soap","bar"},{"soap","tin"},{"closed","bar"},{"soap","broken"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d",len(results))
+	}
+	if !results[0].Found || results[0].Err != nil || results[0].Key != "bar" {
+		t.Fatalf("expecting YES for soap/bar, got %+v",results[0])
+	}
+	if results[1].Found || results[1].Err != KeyNotFound {
+		t.Fatalf("expecting key not found for soap/tin, got %+v",results[1])
+	}
+	if results[2].Found || results[2].Err != Unauthorized {
+		t.Fatalf("expecting unauthorized for closed/bar, got %+v",results[2])
+	}
+	if results[3].Found || results[3].Err != CheckFailed {
+		t.Fatalf("expecting check failed for soap/broken, got %+v",results[3])
+	}
+}
+
+/* an unreachable endpoint is skipped and the one that answered is used from then on */
+func Test_ClientFailover(t *testing.T) {
+
+	srv := timingServer()
+	defer srv.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cl,err := NewClient(WithEndpoints(down.URL,srv.URL),WithRetry(0,0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if cl.Addr != down.URL || len(cl.Endpoints) != 2 {
+		t.Fatalf("incorrect endpoints %s %v",cl.Addr,cl.Endpoints)
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok,err := cl.Check("soap","bar"); !ok || err != nil {
+			t.Fatalf("expecting YES from the second endpoint, got %v %v",ok,err)
+		}
+	}
+	if cl.current != 1 {
+		t.Fatalf("expected the second endpoint to be preferred")
+	}
+
+	online := cl.EndpointsOnline(context.Background())
+	if online[down.URL] || !online[srv.URL] {
+		t.Fatalf("incorrect endpoint health %v",online)
+	}
+	if !cl.IsOnline() {
+		t.Fatalf("expected the service to be online through the second endpoint")
+	}
+}
+
+/* refusingDialer - an http client whose first refuse connections fail before reaching the service */
+func refusingDialer(refuse int32,dials *int32) *http.Client {
+
+	return &http.Client{Transport:&http.Transport{DisableKeepAlives:true,DialContext:func(ctx context.Context,network,addr string) (net.Conn,error) {
+		if atomic.AddInt32(dials,1) <= refuse {
+			return nil,&net.OpError{Op:"dial",Net:network,Err:errors.New("connection refused")}
+		}
+		return (&net.Dialer{}).DialContext(ctx,network,addr)
+	}}}
+}
+
+/* only a check that never reached the service is retried with backoff, never past the caller's deadline */
+func Test_ClientRetry(t *testing.T) {
+
+	var requests,dials int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+
+		if atomic.AddInt32(&requests,1) == 1 {
+			http.Error(w,"Service Unavailable",503)
+			return
+		}
+		if req.Method == "POST" {
+			fmt.Fprint(w,`[{"bucket":"soap","key":"bar","result":"yes"}]`)
+			return
+		}
+		fmt.Fprint(w,"yes")
+	}))
+	defer srv.Close()
+
+	if cl,_ := NewClient(); cl.Retries != 0 {
+		t.Fatalf("expected no retries by default, got %d",cl.Retries)
+	}
+
+	cl,err := NewClient(WithAddr(srv.URL),WithRetry(2,10 * time.Millisecond),WithHttpClient(refusingDialer(0,&dials)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	/* the service saw the check, it may have consumed a use */
+	if _,err := cl.Check("soap","bar"); err != UnexpectedResponse || atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("expected a 5xx not to be retried, got %v after %d requests",err,requests)
+	}
+
+	cl.HttpClient = refusingDialer(2,&dials)
+	atomic.StoreInt32(&dials,0)
+	if ok,err := cl.Check("soap","bar"); !ok || err != nil {
+		t.Fatalf("expecting YES on the third attempt, got %v %v",ok,err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Fatalf("expected 3 dials, got %d",n)
+	}
+
+	atomic.StoreInt32(&dials,0)
+	cl.Retries = 1
+	if _,err := cl.Check("soap","bar"); err == nil || atomic.LoadInt32(&dials) != 2 {
+		t.Fatalf("expected the check to fail once the retries ran out, got %v after %d dials",err,dials)
+	}
+
+	/* a batch is never retried */
+	atomic.StoreInt32(&dials,0)
+	if _,err := cl.CheckMany([]Pair{{"soap","bar"}}); err == nil || atomic.LoadInt32(&dials) != 1 {
+		t.Fatalf("expected a batch not to be retried, got %v after %d dials",err,dials)
+	}
+
+	/* a backoff longer than the deadline is not waited for */
+	cl.HttpClient = refusingDialer(10,&dials)
+	cl.Backoff = time.Second
+	ctx,cancel := context.WithTimeout(context.Background(),200 * time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	if _,err := cl.CheckContext(ctx,"soap","bar"); err == nil {
+		t.Fatalf("expected the check to fail")
+	}
+	if d := time.Since(t0); d > 150 * time.Millisecond {
+		t.Fatalf("waited past the deadline - took %v",d)
+	}
+}
+
+/* clientCertPEM - a CA and a client certificate for subject signed by it */
+func clientCertPEM(t *testing.T,subject string) (*x509.CertPool,[]byte,[]byte) {
+
+	caKey,_ := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+	caTmpl := &x509.Certificate{SerialNumber:big.NewInt(1),Subject:pkix.Name{CommonName:"ca"},
+		NotBefore:time.Now().Add(-time.Hour),NotAfter:time.Now().Add(time.Hour),
+		IsCA:true,KeyUsage:x509.KeyUsageCertSign,BasicConstraintsValid:true}
+	caDer,err := x509.CreateCertificate(rand.Reader,caTmpl,caTmpl,&caKey.PublicKey,caKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ca,_ := x509.ParseCertificate(caDer)
+
+	key,_ := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber:big.NewInt(2),Subject:pkix.Name{CommonName:subject},
+		NotBefore:time.Now().Add(-time.Hour),NotAfter:time.Now().Add(time.Hour),
+		KeyUsage:x509.KeyUsageDigitalSignature,ExtKeyUsage:[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	der,err := x509.CreateCertificate(rand.Reader,tmpl,ca,&key.PublicKey,caKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keyDer,_ := x509.MarshalECPrivateKey(key)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool,pem.EncodeToMemory(&pem.Block{Type:"CERTIFICATE",Bytes:der}),
+		pem.EncodeToMemory(&pem.Block{Type:"EC PRIVATE KEY",Bytes:keyDer})
+}
+
+/* a client certificate is presented to a service requiring one, no Api Key needed */
+func Test_ClientCertificate(t *testing.T) {
+
+	pool,certPEM,keyPEM := clientCertPEM(t,"gateway")
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 || req.TLS.PeerCertificates[0].Subject.CommonName != "gateway" {
+			http.Error(w,"Unauthorized",401)
+			return
+		}
+		fmt.Fprint(w,"yes")
+	}))
+	srv.TLS = &tls.Config{ClientCAs:pool,ClientAuth:tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	cl,err := NewClient(WithAddr(srv.URL),WithTLS(&tls.Config{RootCAs:roots}),WithClientCert(certPEM,keyPEM),WithRetry(0,0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok,err := cl.Check("soap","bar"); !ok || err != nil {
+		t.Fatalf("expecting YES with a client certificate, got %v %v",ok,err)
+	}
+
+	anon,err := NewClient(WithAddr(srv.URL),WithTLS(&tls.Config{RootCAs:roots}),WithRetry(0,0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok,err := anon.Check("soap","bar"); ok || err == nil {
+		t.Fatalf("expected the handshake to fail without a client certificate")
+	}
+
+	if _,err := NewClient(WithClientCert(certPEM,[]byte("not a key"))); err == nil {
+		t.Fatalf("expected an invalid key pair to be refused")
+	}
+}
+
+/* time n auth checks of bucket/key */
+func timeAuthChecks(cl *Client,n int,bucket,key string) (time.Duration,time.Duration) {
+
+	min,max := time.Duration(1 << 62),time.Duration(0)
+	for i := 0; i < n; i++ {
+		t0 := time.Now()
+		cl.AuthCheckWithTimeout(bucket,key)
+		d := time.Since(t0)
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return min,max
+}
+
+/* yes, no, unauthorized, timeout and a dead service must all take the same padded time */
+func Test_ClientTiming(t *testing.T) {
+
+	srv := timingServer()
+	defer srv.Close()
+
+	atLeast := 150 * time.Millisecond
+	slack := 40 * time.Millisecond
+	cl,err := NewClient(WithAddr(srv.URL),WithAtLeast(atLeast),WithTimeout(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dead,err := NewClient(WithAddr("127.0.0.1:1"),WithAtLeast(atLeast),WithTimeout(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _,c := range []struct {
+		outcome string
+		cl *Client
+		bucket,key string
+	}{
+		{"yes",cl,"soap","bar"},
+		{"no",cl,"soap","tin"},
+		{"unauthorized",cl,"closed","bar"},
+		{"timeout",cl,"soap","slow"},
+		{"error",dead,"soap","bar"}} {
+
+		min,max := timeAuthChecks(c.cl,5,c.bucket,c.key)
+		if min < atLeast || max > atLeast + slack {
+			t.Fatalf("%s took between %v and %v, expected %v",c.outcome,min,max,atLeast)
+		}
+	}
+
+	/* a timeout longer than the minimum is cut to it */
+	cl.Timeout = 5 * time.Second
+	for _,key := range []string{"bar","slow"} {
+		min,max := timeAuthChecks(cl,3,"soap",key)
+		if min < atLeast || max > atLeast + slack {
+			t.Fatalf("%s took between %v and %v, expected %v",key,min,max,atLeast)
+		}
+	}
+}
+
+/* jittered padding is spread over [AtLeast,AtLeast + Jitter) whatever the outcome */
+func Test_ClientJitter(t *testing.T) {
+
+	srv := timingServer()
+	defer srv.Close()
+
+	atLeast,jitter := 100 * time.Millisecond,100 * time.Millisecond
+	cl,err := NewClient(WithAddr(srv.URL),WithAtLeast(atLeast),WithJitter(jitter),WithTimeout(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _,key := range []string{"bar","tin","slow"} {
+
+		min,max := timeAuthChecks(cl,12,"soap",key)
+		if min < atLeast || max > atLeast + jitter + 40 * time.Millisecond {
+			t.Fatalf("%s took between %v and %v, expected within %v + %v",key,min,max,atLeast,jitter)
+		}
+		if max - min < jitter / 5 {
+			t.Fatalf("%s took between %v and %v, expected the padding to be spread",key,min,max)
+		}
+	}
+}
+
 /* dummy server for testing client api */
 
 type DummyServe struct {
@@ -225,7 +726,7 @@ func dummy() {
 		dumb := new(DummyServe)
 		dumb.r = mux.NewRouter()
 		dumb.r.StrictSlash(false)
-		dumb.r.HandleFunc("/api/v1/check/{bucket}/{key}/",CheckHandler)
+		dumb.r.HandleFunc("/api/v1/g/{bucket}/{key}",CheckHandler).Methods("GET")
 		dumb.r.HandleFunc("/api/v1/status/",StatusHandler)
 	
 		srv := &http.Server{
@@ -259,6 +760,13 @@ func CheckHandler(w http.ResponseWriter,req *http.Request) {
 	bucket := vars["bucket"]
 	key := vars["key"]
 
+	if req.Header.Get("X-ApiKey") != apiKey || bucket == "closed" {
+
+		/* the service answers the same for a bad key and a bucket that is not live */
+		http.Error(w,"Unauthorized",401)
+		return
+	}
+
 	if bucket == "soap" && key == "bubble" {
 		
 		/* the default timeout for the client is 5 seconds */
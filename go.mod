@@ -0,0 +1,11 @@
+module github.com/bazaar-technology/authd
+
+go 1.22
+
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
+	go.etcd.io/bbolt v1.3.11
+)
+
+require golang.org/x/sys v0.4.0 // indirect